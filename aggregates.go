@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+)
+
+// Table name in database that will be created by this program and filled with
+// the cross-sectional funding stats and equal weighted mark return of the
+// universe at every settlement, so analysis reads a small precomputed series
+// instead of aggregating fundingTableName
+var fundingAggregatesTableName = universeName + "_funding_aggregates"
+
+// createFundingAggregatesTable creates fundingAggregatesTableName if it does
+// not exist and fills it for every rebalance period already stored when it
+// was just created
+func createFundingAggregatesTable(ctx context.Context, dbpool *pgxpool.Pool) {
+	var tableExists bool
+	err := dbpool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = '`+fundingAggregatesTableName+`')`).Scan(&tableExists)
+	if err != nil {
+		log.Fatal("QueryRow failed | ", err)
+	}
+	if tableExists {
+		return
+	}
+	// #region Create table "topN_funding_aggregates"
+	queryCreateTable := `CREATE TABLE ` + fundingAggregatesTableName + `(
+		settlement_time TIMESTAMPTZ PRIMARY KEY,
+		funding_time BIGINT NOT NULL,
+		symbols INTEGER NOT NULL,
+		mean_funding_rate DECIMAL NOT NULL,
+		median_funding_rate DECIMAL NOT NULL,
+		q1_funding_rate DECIMAL NOT NULL,
+		q3_funding_rate DECIMAL NOT NULL,
+		min_funding_rate DECIMAL NOT NULL,
+		max_funding_rate DECIMAL NOT NULL,
+		std_funding_rate DECIMAL,
+		mad_funding_rate DECIMAL NOT NULL,
+		mark_return DECIMAL,
+		mark_return_symbols INTEGER NOT NULL
+		);
+		`
+	_, err = dbpool.Exec(ctx, queryCreateTable)
+	if err != nil {
+		log.Fatalf("Unable to create the '%s' table | %v", fundingAggregatesTableName, err)
+	} // #endregion
+
+	// #region Fill the periods already stored
+	periods := rebalancePeriods(ctx, dbpool, `TRUE`)
+	for _, period := range periods {
+		updateFundingAggregates(ctx, dbpool, period)
+	}
+	log.Printf("Filled table %s for %d rebalance periods", fundingAggregatesTableName, len(periods)) // #endregion
+}
+
+// updateFundingAggregates replaces the aggregates of the settlements in period
+// with the stats of the universe members stored in fundingTableName. Each
+// member's mark return runs from its previous settlement, whether or not it
+// was in the universe then, and is NULL when there's no stored settlement in
+// the 8h before, the longest funding interval binance uses, so a gap in the
+// history isn't counted as one interval's return
+func updateFundingAggregates(ctx context.Context, dbpool *pgxpool.Pool, period data.Period) {
+	queryUpdateAggregates := `
+		WITH members AS (
+			SELECT f.settlement_time, f.funding_time, f.funding_rate, f.mark_price / NULLIF(previous.mark_price, 0) - 1 AS mark_return
+			FROM ` + fundingTableName + ` f
+			LEFT JOIN LATERAL (
+				SELECT COALESCE(s.mark_price, p.mark_price) AS mark_price
+				FROM ` + fundingSettlementsTableName + ` s
+				LEFT JOIN ` + markPricesTableName + ` p ON p.binance_symbol = s.binance_symbol AND p.mark_time = s.settlement_time
+				WHERE s.binance_symbol = f.binance_symbol AND s.settlement_time < f.settlement_time
+				AND s.settlement_time >= f.settlement_time - INTERVAL '8 hours'
+				ORDER BY s.settlement_time DESC
+				LIMIT 1
+			) previous ON TRUE
+			WHERE f.rebalance_date = $1
+		), medians AS (
+			SELECT settlement_time, PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY funding_rate) AS median
+			FROM members
+			GROUP BY settlement_time
+		)
+		INSERT INTO ` + fundingAggregatesTableName + `
+		SELECT m.settlement_time, MIN(m.funding_time), COUNT(*),
+			AVG(m.funding_rate),
+			md.median::DECIMAL,
+			(PERCENTILE_CONT(0.25) WITHIN GROUP (ORDER BY m.funding_rate))::DECIMAL,
+			(PERCENTILE_CONT(0.75) WITHIN GROUP (ORDER BY m.funding_rate))::DECIMAL,
+			MIN(m.funding_rate),
+			MAX(m.funding_rate),
+			STDDEV_SAMP(m.funding_rate),
+			(PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY ABS(m.funding_rate - md.median::DECIMAL)))::DECIMAL,
+			AVG(m.mark_return),
+			COUNT(m.mark_return)
+		FROM members m
+		JOIN medians md ON md.settlement_time = m.settlement_time
+		GROUP BY m.settlement_time, md.median;
+		`
+	batch := &pgx.Batch{}
+	batch.Queue(`DELETE FROM `+fundingAggregatesTableName+` WHERE settlement_time >= $1 AND settlement_time < $2`, period.Rebalance, period.End)
+	batch.Queue(queryUpdateAggregates, period.Rebalance)
+	br := dbpool.SendBatch(ctx, batch)
+	_, err := br.Exec()
+	if err != nil {
+		log.Fatalf("Unable to update the '%s' table | %v", fundingAggregatesTableName, err)
+	}
+	_, err = br.Exec()
+	if err != nil {
+		log.Fatalf("Unable to update the '%s' table | %v", fundingAggregatesTableName, err)
+	}
+	err = br.Close()
+	if err != nil {
+		log.Fatal("Error closing batch | ", err)
+	}
+}
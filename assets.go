@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+)
+
+// Table name in database that will be created by this program and filled with
+// the CoinMarketCap assets sharing a Binance contract at each snapshot and the
+// one chosen for the universe
+var ambiguousTickersTableName = universeName + "_ambiguous_tickers"
+
+// Columns of snapshotsTableName holding a stable CoinMarketCap asset id, in
+// order of preference. Snapshot sources without either fall back to the ticker
+var assetIdColumns = []string{"slug", "cmc_id"}
+
+// Column of snapshotsTableName assets are identified by, set on first use
+var assetIdColumn string
+
+// snapshotAssetIdColumn returns the first of assetIdColumns snapshotsTableName
+// has, or symbol if it has neither
+func snapshotAssetIdColumn(ctx context.Context, dbpool *pgxpool.Pool) string {
+	if assetIdColumn != "" {
+		return assetIdColumn
+	}
+	columnRows, err := dbpool.Query(ctx, `SELECT column_name::TEXT FROM information_schema.columns WHERE table_name = '`+snapshotsTableName+`'`)
+	if err != nil {
+		log.Fatal("error querying rows | ", err)
+	}
+	columns, err := pgx.CollectRows(columnRows, pgx.RowTo[string])
+	if err != nil {
+		log.Fatal("error collecting rows | ", err)
+	}
+	assetIdColumn = "symbol"
+	for _, idColumn := range assetIdColumns {
+		if slices.Contains(columns, idColumn) {
+			assetIdColumn = idColumn
+			break
+		}
+	}
+	if assetIdColumn == "symbol" {
+		log.Printf("No slug or cmc_id column in %s. Assets are identified by ticker and data.AssetContracts doesn't apply", snapshotsTableName)
+	} else {
+		log.Printf("Identifying assets in %s by the %s column", snapshotsTableName, assetIdColumn)
+	}
+	return assetIdColumn
+}
+
+// assetContract returns the Binance contract of asset, from data.AssetContracts
+// if it is mapped there by the id in idColumn and by ticker otherwise
+func assetContract(asset data.Asset, idColumn string) (string, bool) {
+	for _, mapping := range data.AssetContracts {
+		if (idColumn == "slug" && asset.Id == mapping.Slug) || (idColumn == "cmc_id" && asset.Id == mapping.CmcId) {
+			return mapping.Contract, true
+		}
+	}
+	return binanceSymbol(asset.Symbol), false
+}
+
+// snapshotContracts returns the ranked assets at snapshot keyed by their
+// Binance contract. When several assets map to one contract, the explicitly
+// mapped asset wins, then the best ranked, and the collision is returned for
+// the ambiguous tickers report
+func snapshotContracts(ctx context.Context, dbpool *pgxpool.Pool, snapshot time.Time) (map[string]data.Asset, []data.AmbiguousTicker) {
+	// #region Query every asset at snapshot by its stable id
+	idColumn := snapshotAssetIdColumn(ctx, dbpool)
+	assetRows, err := dbpool.Query(ctx, `SELECT `+idColumn+`::TEXT, symbol, rank FROM `+snapshotsTableName+` WHERE snapshot_date = '`+snapshot.Format("2006-01-02")+`' AND rank > 0 ORDER BY rank ASC`)
+	if err != nil {
+		log.Fatal("error querying rows | ", err)
+	}
+	assets, err := pgx.CollectRows(assetRows, pgx.RowToStructByPos[data.Asset])
+	if err != nil {
+		log.Fatal("error collecting rows | ", err)
+	} // #endregion
+
+	// #region Group assets by contract, explicitly mapped assets first
+	grouped := make(map[string][]data.Asset)
+	mapped := make(map[string]bool)
+	for _, asset := range assets {
+		contract, explicit := assetContract(asset, idColumn)
+		if explicit {
+			mapped[asset.Id] = true
+		}
+		grouped[contract] = append(grouped[contract], asset)
+	}
+	contracts := make(map[string]data.Asset)
+	var ambiguous []data.AmbiguousTicker
+	for contract, group := range grouped {
+		sort.SliceStable(group, func(i, j int) bool {
+			return mapped[group[i].Id] && !mapped[group[j].Id]
+		})
+		contracts[contract] = group[0]
+		if len(group) == 1 {
+			continue
+		}
+		for i, asset := range group {
+			ambiguous = append(ambiguous, data.AmbiguousTicker{
+				SnapshotDate:  snapshot,
+				Symbol:        asset.Symbol,
+				AssetId:       asset.Id,
+				Rank:          asset.Rank,
+				BinanceSymbol: contract,
+				Chosen:        i == 0,
+			})
+		}
+	} // #endregion
+	return contracts, ambiguous
+}
+
+// recordAmbiguousTickers creates ambiguousTickersTableName if it does not
+// exist and replaces the collisions recorded at snapshot with ambiguous
+func recordAmbiguousTickers(ctx context.Context, dbpool *pgxpool.Pool, snapshot time.Time, ambiguous []data.AmbiguousTicker) {
+	// #region Create table "topN_ambiguous_tickers" if not exists
+	queryCreateTable := `CREATE TABLE IF NOT EXISTS ` + ambiguousTickersTableName + `(
+		snapshot_date DATE NOT NULL,
+		symbol TEXT NOT NULL,
+		asset_id TEXT NOT NULL,
+		rank INTEGER NOT NULL,
+		binance_symbol TEXT NOT NULL,
+		chosen BOOLEAN NOT NULL,
+
+		PRIMARY KEY (snapshot_date, binance_symbol, rank)
+		);
+		`
+	_, err := dbpool.Exec(ctx, queryCreateTable)
+	if err != nil {
+		log.Fatalf("Unable to create the '%s' table | %v", ambiguousTickersTableName, err)
+	} // #endregion
+
+	// #region Batch replace the snapshot's collisions
+	batch := &pgx.Batch{}
+	batch.Queue(`DELETE FROM ` + ambiguousTickersTableName + ` WHERE snapshot_date = '` + snapshot.Format("2006-01-02") + `'`)
+	queryInsertData := `
+		INSERT INTO ` + ambiguousTickersTableName + `
+		(snapshot_date, symbol, asset_id, rank, binance_symbol, chosen)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (snapshot_date, binance_symbol, rank) DO NOTHING;
+		`
+	for _, ticker := range ambiguous {
+		batch.Queue(queryInsertData, ticker.SnapshotDate, ticker.Symbol, ticker.AssetId, ticker.Rank, ticker.BinanceSymbol, ticker.Chosen)
+		if !ticker.Chosen {
+			log.Printf("Ambiguous ticker at snapshot %s. %s (%s, CMC rank %d) also maps to %s", snapshot.Format("2006-01-02"), ticker.Symbol, ticker.AssetId, ticker.Rank, ticker.BinanceSymbol)
+		}
+	}
+	br := dbpool.SendBatch(ctx, batch)
+	_, err = br.Exec()
+	if err != nil {
+		log.Fatal("Unable to execute statement in batch queue | ", err)
+	}
+	err = br.Close()
+	if err != nil {
+		log.Fatal("Error closing batch | ", err)
+	} // #endregion
+}
+
+// reportAmbiguousTickers prints every Binance contract more than one
+// CoinMarketCap asset mapped to, the snapshots it happened at and the asset
+// chosen. Add entries to data.AssetContracts to resolve them explicitly
+func reportAmbiguousTickers(ctx context.Context, dbpool *pgxpool.Pool) {
+	type collision struct {
+		Contract  string
+		Chosen    string
+		Skipped   sql.NullString
+		Snapshots int64
+		First     time.Time
+		Last      time.Time
+	}
+	collisionRows, err := dbpool.Query(ctx, `
+		WITH snapshots AS (
+			SELECT snapshot_date, binance_symbol,
+				string_agg(asset_id, ', ') FILTER (WHERE chosen) AS chosen,
+				string_agg(asset_id, ', ' ORDER BY asset_id) FILTER (WHERE NOT chosen) AS skipped
+			FROM `+ambiguousTickersTableName+`
+			GROUP BY snapshot_date, binance_symbol
+		)
+		SELECT binance_symbol, chosen, skipped, COUNT(*), MIN(snapshot_date), MAX(snapshot_date)
+		FROM snapshots
+		GROUP BY binance_symbol, chosen, skipped
+		ORDER BY binance_symbol, MIN(snapshot_date)`)
+	if err != nil {
+		log.Fatal("error querying rows | ", err)
+	}
+	collisions, err := pgx.CollectRows(collisionRows, pgx.RowToStructByPos[collision])
+	if err != nil {
+		log.Fatal("error collecting rows | ", err)
+	}
+	if len(collisions) == 0 {
+		fmt.Println("No ambiguous tickers recorded in", ambiguousTickersTableName)
+		return
+	}
+	for _, c := range collisions {
+		skipped := c.Skipped.String
+		if !c.Skipped.Valid {
+			skipped = "unrecorded assets"
+		}
+		fmt.Printf("%s: chose %s over %s at %d snapshots from %s to %s\n", c.Contract, c.Chosen, skipped, c.Snapshots, c.First.Format("2006-01-02"), c.Last.Format("2006-01-02"))
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+)
+
+// Table name in database that will be created by this program and filled with
+// every candidate considered for the universe at each rebalance and the reason
+// it was included or excluded
+var universeAuditTableName = universeName + "_universe_audit"
+
+// Reasons stored in universeAuditTableName
+const (
+	reasonIncluded    = "included"
+	reasonStablecoin  = "stablecoin"
+	reasonDuplicate   = "ticker collision"
+	reasonNoRank      = "no CMC rank"
+	reasonNotListed   = "not listed on binance"
+	reasonIncomplete  = "incomplete funding history"
+	reasonTopNReached = "topN reached before rank"
+)
+
+// newAuditRecord returns the audit record of candidate, included only when
+// reason is reasonIncluded. A rank of 0 is stored as NULL. Dates are set by
+// recordUniverseAudit
+func newAuditRecord(candidate data.Symbol, reason string, detail string) data.AuditRecord {
+	if candidate.Contract == "" {
+		candidate.Contract = binanceSymbol(candidate.Symbol)
+	}
+	return data.AuditRecord{
+		Symbol:        candidate.Symbol,
+		BinanceSymbol: candidate.Contract,
+		Rank:          sql.NullInt64{Int64: candidate.Rank, Valid: candidate.Rank != 0},
+		Included:      reason == reasonIncluded,
+		Reason:        reason,
+		Detail:        detail,
+		AssetId:       candidate.AssetId,
+	}
+}
+
+// createUniverseAuditTable creates universeAuditTableName if it does not exist
+func createUniverseAuditTable(ctx context.Context, dbpool *pgxpool.Pool) {
+	queryCreateTable := `CREATE TABLE IF NOT EXISTS ` + universeAuditTableName + `(
+		snapshot_date DATE NOT NULL,
+		symbol TEXT NOT NULL,
+		binance_symbol TEXT,
+		rank INTEGER,
+		included BOOLEAN NOT NULL,
+		reason TEXT NOT NULL,
+		detail TEXT,
+		rebalance_date DATE NOT NULL,
+		asset_id TEXT,
+		provisional BOOLEAN NOT NULL DEFAULT FALSE,
+
+		PRIMARY KEY (rebalance_date, symbol, reason)
+		);
+		`
+	_, err := dbpool.Exec(ctx, queryCreateTable)
+	if err != nil {
+		log.Fatalf("Unable to create the '%s' table | %v", universeAuditTableName, err)
+	}
+}
+
+// recordUniverseAudit replaces the audit records of period with records in tx,
+// so they're committed with the period's memberships. Records of a period in
+// progress are provisional and the period is refetched by the next run
+func recordUniverseAudit(ctx context.Context, tx pgx.Tx, period data.Period, records []data.AuditRecord) {
+	batch := &pgx.Batch{}
+	batch.Queue(`DELETE FROM ` + universeAuditTableName + ` WHERE rebalance_date = '` + period.Rebalance.Format("2006-01-02") + `'`)
+	queryInsertData := `
+		INSERT INTO ` + universeAuditTableName + `
+		(snapshot_date, symbol, binance_symbol, rank, included, reason, detail, rebalance_date, asset_id, provisional)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10)
+		ON CONFLICT (rebalance_date, symbol, reason) DO NOTHING;
+		`
+	for _, record := range records {
+		batch.Queue(queryInsertData, period.Snapshot, record.Symbol, record.BinanceSymbol, record.Rank, record.Included, record.Reason, record.Detail, period.Rebalance, record.AssetId, periodInProgress(period))
+	}
+	br := tx.SendBatch(ctx, batch)
+	_, err := br.Exec()
+	if err != nil {
+		log.Fatal("Unable to execute statement in batch queue | ", err)
+	}
+	err = br.Close()
+	if err != nil {
+		log.Fatal("Error closing batch | ", err)
+	}
+	log.Printf("Recorded %d universe candidates to table %s at rebalance_date %s", len(records), universeAuditTableName, period.Rebalance)
+}
+
+// explainUniverse prints why symbol was or wasn't in the universe for the
+// rebalance period containing date
+func explainUniverse(ctx context.Context, dbpool *pgxpool.Pool, symbol string, date string) {
+	// #region Parse date and find the rebalance period containing it
+	day, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		log.Fatal("Unable to parse date, expected YYYY-MM-DD | ", err)
+	}
+	var rebalance, snapshot time.Time
+	err = dbpool.QueryRow(ctx, `SELECT rebalance_date, snapshot_date FROM `+universeAuditTableName+` WHERE rebalance_date <= '`+day.Format("2006-01-02")+`' ORDER BY rebalance_date DESC LIMIT 1`).Scan(&rebalance, &snapshot)
+	if err == pgx.ErrNoRows {
+		// nothing ingested yet, explain by the weekly snapshot
+		rebalance = snapshotOf(day)
+		snapshot = rebalance
+	} else if err != nil {
+		log.Fatal("Error scanning row | ", err)
+	}
+	contract := binanceSymbol(symbol)
+	symbol = dbSymbol(contract)
+	fmt.Printf("%s in %s for the period rebalanced %s on snapshot %s\n", symbol, fundingTableName, rebalance.Format("2006-01-02"), snapshot.Format("2006-01-02")) // #endregion
+
+	// #region Print audit records for the symbol
+	auditRows, err := dbpool.Query(ctx, `SELECT snapshot_date, rebalance_date, symbol, binance_symbol, rank, included, reason, COALESCE(detail, ''), COALESCE(asset_id, '') FROM `+universeAuditTableName+` WHERE rebalance_date = '`+rebalance.Format("2006-01-02")+`' AND (symbol = '`+symbol+`' OR binance_symbol = '`+contract+`') ORDER BY included DESC`)
+	if err != nil {
+		log.Fatal("error querying rows | ", err)
+	}
+	records, err := pgx.CollectRows(auditRows, pgx.RowToStructByPos[data.AuditRecord])
+	if err != nil {
+		log.Fatal("error collecting rows | ", err)
+	}
+	for _, record := range records {
+		decision := "excluded"
+		if record.Included {
+			decision = "included"
+		}
+		rank := "none"
+		if record.Rank.Valid {
+			rank = strconv.FormatInt(record.Rank.Int64, 10)
+		}
+		fmt.Printf("  %s (%s, CMC rank %s", decision, record.BinanceSymbol, rank)
+		if record.AssetId != "" && record.AssetId != record.Symbol {
+			fmt.Printf(", CMC asset %s", record.AssetId)
+		}
+		fmt.Printf("): %s", record.Reason)
+		if record.Detail != "" {
+			fmt.Printf(" (%s)", record.Detail)
+		}
+		fmt.Println()
+	} // #endregion
+
+	// #region Explain symbols that were never candidates
+	if len(records) == 0 {
+		var rank int64
+		err = dbpool.QueryRow(ctx, `SELECT rank FROM `+snapshotsTableName+` WHERE snapshot_date = '`+snapshot.Format("2006-01-02")+`' AND symbol = '`+symbol+`' ORDER BY rank ASC LIMIT 1`).Scan(&rank)
+		switch {
+		case err == pgx.ErrNoRows:
+			fmt.Printf("  not a candidate: no CMC rank in %s at this snapshot\n", snapshotsTableName)
+		case err != nil:
+			log.Fatal("Error scanning row | ", err)
+		default:
+			fmt.Printf("  not a candidate: CMC rank %d but not in the Binance futures symbols list for this period, or the snapshot hasn't been ingested yet\n", rank)
+		}
+	} // #endregion
+
+	// #region Print the universe for context
+	includedRows, err := dbpool.Query(ctx, `SELECT symbol || ' (' || COALESCE(rank::TEXT, '-') || ')' FROM `+universeAuditTableName+` WHERE rebalance_date = '`+rebalance.Format("2006-01-02")+`' AND included ORDER BY rank ASC`)
+	if err != nil {
+		log.Fatal("error querying rows | ", err)
+	}
+	included, err := pgx.CollectRows(includedRows, pgx.RowTo[string])
+	if err != nil {
+		log.Fatal("error collecting rows | ", err)
+	}
+	fmt.Printf("Universe at rebalance %s: %v\n", rebalance.Format("2006-01-02"), included) // #endregion
+}
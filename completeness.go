@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+)
+
+// completeness is a policy deciding whether a symbol's funding records for a
+// rebalance period are complete enough for the symbol to enter the universe
+type completeness string
+
+const (
+	// Every settlement of the period. The in-progress period is never stored
+	policyStrict completeness = "strict"
+	// At least minCompleteFraction of the period's settlements, so symbols
+	// listed or delisted mid-period aren't dropped entirely
+	policyMinFraction completeness = "min-fraction"
+	// Every settlement for completed periods, and every settlement so far for
+	// the in-progress period
+	policyAllowPartialCurrentWeek completeness = "allow-partial-current-week"
+)
+
+// periodInProgress returns true when period hasn't ended. Rows for an
+// in-progress period are stored as provisional and replaced by the next run
+func periodInProgress(period data.Period) bool {
+	return time.Now().Before(period.End)
+}
+
+// fundingInterval returns the interval a symbol settled on in fundingRates,
+// the most common spacing between consecutive settlements so a missing record
+// doesn't lengthen it. Ties go to the shorter spacing. Symbols with fewer than
+// two records are assumed to settle every defaultFundingInterval
+func fundingInterval(fundingRates []data.FundingRateApiResp) time.Duration {
+	counts := make(map[time.Duration]int)
+	interval := defaultFundingInterval
+	for i := 1; i < len(fundingRates); i++ {
+		spacing := settlementTime(fundingRates[i].Time).Sub(settlementTime(fundingRates[i-1].Time))
+		if spacing <= 0 {
+			continue
+		}
+		counts[spacing]++
+		if len(counts) == 1 || counts[spacing] > counts[interval] || (counts[spacing] == counts[interval] && spacing < interval) {
+			interval = spacing
+		}
+	}
+	return interval
+}
+
+// periodSettlements returns the number of funding settlements in period of a
+// symbol settling every interval
+func periodSettlements(period data.Period, interval time.Duration) int {
+	return int(period.End.Sub(period.Rebalance) / interval)
+}
+
+// expectedSettlements returns the number of settlements every interval
+// binance should have published from the start of period up to its end or
+// now, whichever comes first
+func expectedSettlements(period data.Period, interval time.Duration) int {
+	if !periodInProgress(period) {
+		return periodSettlements(period, interval)
+	}
+	elapsed := time.Now().Add(-settlementDelay).Sub(period.Rebalance)
+	if elapsed < 0 {
+		return 0
+	}
+	return int(elapsed/interval) + 1
+}
+
+// isComplete applies completenessPolicy to a symbol's funding records in period
+func isComplete(fundingRates []data.FundingRateApiResp, period data.Period) bool {
+	records := len(fundingRates)
+	interval := fundingInterval(fundingRates)
+	switch completenessPolicy {
+	case policyMinFraction:
+		return float64(records) >= math.Ceil(minCompleteFraction*float64(periodSettlements(period, interval)))
+	case policyAllowPartialCurrentWeek:
+		if periodInProgress(period) {
+			return records > 0 && records >= expectedSettlements(period, interval)
+		}
+		return records >= periodSettlements(period, interval)
+	default:
+		return records >= periodSettlements(period, interval)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+)
+
+// weekPeriod is a completed weekly rebalance period
+var weekPeriod = data.Period{
+	Rebalance: time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC),
+	End:       time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC),
+}
+
+// settlementsEvery returns funding records every interval over period, a few
+// milliseconds late as binance stamps them, skipping the records in missing
+func settlementsEvery(period data.Period, interval time.Duration, missing ...int) []data.FundingRateApiResp {
+	var fundingRates []data.FundingRateApiResp
+	for i, t := 0, period.Rebalance; t.Before(period.End); i, t = i+1, t.Add(interval) {
+		skipped := false
+		for _, m := range missing {
+			skipped = skipped || m == i
+		}
+		if !skipped {
+			fundingRates = append(fundingRates, data.FundingRateApiResp{Symbol: "BTCUSDT", Time: t.UnixMilli() + 3, Rate: "0.0001"})
+		}
+	}
+	return fundingRates
+}
+
+func TestFundingInterval(t *testing.T) {
+	tests := []struct {
+		name         string
+		fundingRates []data.FundingRateApiResp
+		want         time.Duration
+	}{
+		{"8h", settlementsEvery(weekPeriod, 8*time.Hour), 8 * time.Hour},
+		{"4h", settlementsEvery(weekPeriod, 4*time.Hour), 4 * time.Hour},
+		{"1h", settlementsEvery(weekPeriod, time.Hour), time.Hour},
+		{"4h with missing records", settlementsEvery(weekPeriod, 4*time.Hour, 3, 7, 8), 4 * time.Hour},
+		{"one record", settlementsEvery(weekPeriod, 8*time.Hour)[:1], defaultFundingInterval},
+		{"no records", nil, defaultFundingInterval},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fundingInterval(tt.fundingRates); got != tt.want {
+				t.Errorf("interval %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsComplete(t *testing.T) {
+	tests := []struct {
+		name         string
+		fundingRates []data.FundingRateApiResp
+		want         bool
+	}{
+		{"every 8h settlement", settlementsEvery(weekPeriod, 8*time.Hour), true},
+		{"every 4h settlement", settlementsEvery(weekPeriod, 4*time.Hour), true},
+		{"every 1h settlement", settlementsEvery(weekPeriod, time.Hour), true},
+		{"4h missing one settlement", settlementsEvery(weekPeriod, 4*time.Hour, 10), false},
+		{"1h missing one settlement", settlementsEvery(weekPeriod, time.Hour, 100), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isComplete(tt.fundingRates, weekPeriod); got != tt.want {
+				t.Errorf("complete %v with %d records, want %v", got, len(tt.fundingRates), tt.want)
+			}
+		})
+	}
+}
+
+func TestFundingGap(t *testing.T) {
+	if _, ok := fundingGap(settlementsEvery(weekPeriod, 4*time.Hour), weekPeriod); ok {
+		t.Error("gap reported for every 4h settlement")
+	}
+	stopped := settlementsEvery(weekPeriod, 4*time.Hour)
+	stopped = stopped[:len(stopped)-1]
+	if _, ok := fundingGap(stopped, weekPeriod); !ok {
+		t.Error("no gap reported for a 4h symbol missing its last settlement")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// copyMerge bulk loads rows into a temporary staging copy of table with COPY
+// and merges them into table in one statement, which is much faster than a
+// batch of single row INSERTs for full rebuilds. Rows are deduplicated on the
+// conflict columns and onConflict is the action taken for rows already in
+// table, eg. "DO NOTHING". Logs the throughput and returns the rows merged
+func copyMerge(ctx context.Context, tx pgx.Tx, table string, columns []string, conflict []string, onConflict string, rows [][]any) int64 {
+	if len(rows) == 0 {
+		return 0
+	}
+	start := time.Now()
+	stagingTableName := table + "_staging"
+
+	// #region Copy rows to the staging table, dropped when the transaction ends
+	_, err := tx.Exec(ctx, `CREATE TEMP TABLE `+stagingTableName+` (LIKE `+table+` INCLUDING DEFAULTS) ON COMMIT DROP`)
+	if err != nil {
+		log.Fatalf("Unable to create the '%s' table | %v", stagingTableName, err)
+	}
+	copied, err := tx.CopyFrom(ctx, pgx.Identifier{stagingTableName}, columns, pgx.CopyFromRows(rows))
+	if err != nil {
+		log.Fatalf("Unable to copy rows to the '%s' table | %v", stagingTableName, err)
+	} // #endregion
+
+	// #region Merge the staging table into table
+	queryMerge := `
+		INSERT INTO ` + table + ` (` + strings.Join(columns, ", ") + `)
+		SELECT DISTINCT ON (` + strings.Join(conflict, ", ") + `) ` + strings.Join(columns, ", ") + `
+		FROM ` + stagingTableName + `
+		ON CONFLICT (` + strings.Join(conflict, ", ") + `) ` + onConflict
+	tag, err := tx.Exec(ctx, queryMerge)
+	if err != nil {
+		log.Fatalf("Unable to merge the '%s' table into the '%s' table | %v", stagingTableName, table, err)
+	}
+	_, err = tx.Exec(ctx, `DROP TABLE `+stagingTableName)
+	if err != nil {
+		log.Fatalf("Unable to drop the '%s' table | %v", stagingTableName, err)
+	} // #endregion
+
+	elapsed := time.Since(start)
+	log.Printf("Copied %d rows to table %s in %v (%.0f rows/s)", copied, table, elapsed.Round(time.Millisecond), float64(copied)/elapsed.Seconds())
+	return tag.RowsAffected()
+}
+
+// nullIfEmpty returns nil for an empty string so it's copied as NULL
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+)
+
+// Address the serve command's health endpoint listens on
+const healthAddr = ":8080"
+
+// How long after a settlement to wait before fetching it. Binance can publish
+// funding records a little after the settlement time
+const settlementDelay = 2 * time.Minute
+
+// Default funding interval for symbols not listed by the fundingInfo API
+const defaultFundingInterval = 8 * time.Hour
+
+// The health endpoint reports unhealthy when the last successful ingestion is
+// older than this
+const healthStaleAfter = defaultFundingInterval + 2*settlementDelay
+
+// A failed ingestion is retried after retryMinBackoff, doubling after every
+// consecutive failure up to retryMaxBackoff
+const retryMinBackoff = time.Minute
+const retryMaxBackoff = 30 * time.Minute
+
+// daemonStatus is reported by the health endpoint
+type daemonStatus struct {
+	mu                  sync.Mutex
+	Running             bool      `json:"running"`
+	LastRunStart        time.Time `json:"last_run_start"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastFailure         time.Time `json:"last_failure"`
+	LastError           string    `json:"last_error"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	NextRun             time.Time `json:"next_run"`
+	LatestSnapshot      time.Time `json:"latest_snapshot"`
+	Symbols             int       `json:"symbols"`
+}
+
+// serve runs ingest shortly after every funding settlement of the symbols in
+// the latest snapshot of fundingTableName until the program is killed, picking
+// up new weekly snapshots as they appear, and serves the daemon status on
+// healthAddr/health. Each ingestion runs in a child process, so one that exits
+// on an error is recorded as failed and retried with backoff
+func serve(ctx context.Context, dbpool *pgxpool.Pool) {
+	status := &daemonStatus{}
+
+	// #region Serve health endpoint
+	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		status.mu.Lock()
+		defer status.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		// unhealthy while the last run failed or the last success is stale
+		if !status.Running && (status.ConsecutiveFailures > 0 || time.Since(status.LastSuccess) > healthStaleAfter) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+	go func() {
+		log.Printf("Health endpoint listening on %s/health", healthAddr)
+		log.Fatal(http.ListenAndServe(healthAddr, nil))
+	}() // #endregion
+
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatal("Unable to find the executable to run ingestion with | ", err)
+	}
+	var latestSnapshot time.Time
+	retryBackoff := retryMinBackoff
+	for {
+		// #region Run ingestion in a child process
+		status.mu.Lock()
+		status.Running = true
+		status.LastRunStart = time.Now().UTC()
+		status.mu.Unlock()
+
+		cmd := exec.CommandContext(ctx, executable, "ingest")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err := cmd.Run() // #endregion
+
+		// #region Record a failed run and retry it with backoff
+		if err != nil {
+			nextRun := time.Now().UTC().Add(retryBackoff)
+			status.mu.Lock()
+			status.Running = false
+			status.LastFailure = time.Now().UTC()
+			status.LastError = err.Error()
+			status.ConsecutiveFailures += 1
+			status.NextRun = nextRun
+			status.mu.Unlock()
+
+			log.Printf("Ingestion failed | %v. Retrying at %s", err, nextRun)
+			time.Sleep(retryBackoff)
+			retryBackoff = min(retryBackoff*2, retryMaxBackoff)
+			continue
+		}
+		retryBackoff = retryMinBackoff // #endregion
+
+		// #region Record a successful run and pick up new snapshots
+		var snapshot time.Time
+		dbpool.QueryRow(ctx, `SELECT MAX(snapshot_date) FROM `+snapshotsTableName).Scan(&snapshot)
+		if snapshot.After(latestSnapshot) {
+			if !latestSnapshot.IsZero() {
+				log.Println("New weekly snapshot found, universe refreshed at snapshot date: ", snapshot)
+			}
+			latestSnapshot = snapshot
+		}
+		status.mu.Lock()
+		status.LastSuccess = time.Now().UTC()
+		status.ConsecutiveFailures = 0
+		status.LatestSnapshot = latestSnapshot
+		status.mu.Unlock() // #endregion
+
+		// #region Schedule next run after the earliest upcoming settlement
+		contracts, err := latestContracts(ctx, dbpool)
+		if err != nil {
+			log.Println("Unable to query the latest universe, scheduling by the default funding interval | ", err)
+		}
+		intervals, err := getFundingIntervals()
+		if err != nil {
+			log.Println("Unable to poll funding intervals, scheduling by the default funding interval | ", err)
+		}
+		now := time.Now().UTC()
+		nextSettlement := now.Truncate(defaultFundingInterval).Add(defaultFundingInterval)
+		for _, contract := range contracts {
+			interval, ok := intervals[contract]
+			if !ok {
+				interval = defaultFundingInterval
+			}
+			settlement := now.Truncate(interval).Add(interval)
+			if settlement.Before(nextSettlement) {
+				nextSettlement = settlement
+			}
+		}
+		nextRun := nextSettlement.Add(settlementDelay)
+
+		status.mu.Lock()
+		status.Running = false
+		status.NextRun = nextRun
+		status.Symbols = len(contracts)
+		status.mu.Unlock()
+
+		log.Printf("Ingestion finished. Next run at %s", nextRun)
+		time.Sleep(time.Until(nextRun)) // #endregion
+	}
+}
+
+// latestContracts returns the contracts of the universe's latest rebalance
+func latestContracts(ctx context.Context, dbpool *pgxpool.Pool) ([]string, error) {
+	contractRows, err := dbpool.Query(ctx, `SELECT binance_symbol FROM `+fundingTableName+` WHERE rebalance_date = (SELECT MAX(rebalance_date) FROM `+fundingTableName+`) GROUP BY binance_symbol`)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(contractRows, pgx.RowTo[string])
+}
+
+// getFundingIntervals polls the binance fundingInfo API for the symbols whose
+// funding interval differs from the default, keyed by contract symbol
+func getFundingIntervals() (map[string]time.Duration, error) {
+	res, err := http.Get("https://fapi.binance.com/fapi/v1/fundingInfo")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	msg, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	var fundingInfo []data.FundingInfoApiResp
+	err = json.Unmarshal(msg, &fundingInfo)
+	if err != nil {
+		return nil, fmt.Errorf("%s | %w", msg, err)
+	}
+	intervals := make(map[string]time.Duration)
+	for _, info := range fundingInfo {
+		if info.IntervalHours > 0 {
+			intervals[info.Symbol] = time.Duration(info.IntervalHours) * time.Hour
+		}
+	}
+	return intervals, nil
+}
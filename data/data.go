@@ -2,27 +2,80 @@ package data
 
 import (
 	"database/sql"
+	"encoding/json"
 	"time"
+
+	"github.com/shopspring/decimal"
 )
 
 type Symbol struct {
+	Symbol   string
+	Rank     int64
+	AssetId  string
+	Contract string
+}
+
+type Asset struct {
+	Id     string
 	Symbol string
 	Rank   int64
 }
 
-type Row struct {
-	FundingTime  int64
-	Symbol       string
-	FundingRate  float64
-	MarkPrice    sql.NullFloat64
-	SnapshotDate time.Time
-	Rank         int64
+type SymbolContract struct {
+	Symbol   string
+	Contract string
+}
+
+type AmbiguousTicker struct {
+	SnapshotDate  time.Time
+	Symbol        string
+	AssetId       string
+	Rank          int64
+	BinanceSymbol string
+	Chosen        bool
+}
+
+type Period struct {
+	Rebalance time.Time
+	End       time.Time
+	Snapshot  time.Time
+}
+
+type Settlement struct {
+	BinanceSymbol string
+	// binance's timestamp and the settlement it belongs to
+	FundingTime    time.Time
+	SettlementTime time.Time
+	FundingRate    decimal.Decimal
+	MarkPrice      decimal.NullDecimal
+}
+
+type Instrument struct {
+	BinanceSymbol string
+	Symbol        string
+	AssetId       string
+	// units of the coin one contract quotes, mark prices are per contract
+	ContractMultiplier decimal.Decimal
+}
+
+type Membership struct {
+	Universe      string
+	RebalanceDate time.Time
+	PeriodEnd     time.Time
+	SnapshotDate  time.Time
+	AssetId       string
+	Symbol        string
+	BinanceSymbol string
+	Rank          int64
+	Provisional   bool
 }
 
 type MarkApiResp struct {
-	Symbol string
-	Time   int64
-	Mark   float64
+	Symbol  string
+	Time    int64
+	Mark    decimal.NullDecimal
+	Index   decimal.NullDecimal
+	Premium decimal.NullDecimal
 }
 
 type FundingRateApiResp struct {
@@ -32,26 +85,127 @@ type FundingRateApiResp struct {
 	Mark   string `json:"markPrice"`
 }
 
+type SpotApiResp struct {
+	Symbol string
+	Time   int64
+	Price  decimal.NullDecimal
+}
+
+type DelistingEvent struct {
+	Symbol       string
+	Time         int64
+	Type         string
+	SnapshotDate time.Time
+}
+
+type AuditRecord struct {
+	SnapshotDate  time.Time
+	RebalanceDate time.Time
+	Symbol        string
+	BinanceSymbol string
+	Rank          sql.NullInt64
+	Included      bool
+	Reason        string
+	Detail        string
+	AssetId       string
+}
+
+type FuturesDataApiResp struct {
+	Symbol string
+	Time   int64
+	Values []string
+}
+
+type ExchangeInfoApiResp struct {
+	Symbols []ExchangeInfoSymbol `json:"symbols"`
+}
+
+type ExchangeInfoSymbol struct {
+	Symbol       string `json:"symbol"`
+	Pair         string `json:"pair"`
+	ContractType string `json:"contractType"`
+	DeliveryDate int64  `json:"deliveryDate"`
+	OnboardDate  int64  `json:"onboardDate"`
+	Status       string `json:"status"`
+	BaseAsset    string `json:"baseAsset"`
+	QuoteAsset   string `json:"quoteAsset"`
+}
+
+type QuarterlyBasis struct {
+	Symbol          string
+	ContractType    string
+	Time            int64
+	DeliveryTime    int64
+	FuturesPrice    decimal.Decimal
+	IndexPrice      decimal.Decimal
+	Basis           decimal.Decimal
+	AnnualizedBasis decimal.Decimal
+}
+
+type FundingInfoApiResp struct {
+	Symbol        string `json:"symbol"`
+	IntervalHours int64  `json:"fundingIntervalHours"`
+}
+
+type CombinedStreamMsg struct {
+	Stream string          `json:"stream"`
+	Data   json.RawMessage `json:"data"`
+}
+
+type MarkPriceEvent struct {
+	EventType       string `json:"e"`
+	Time            int64  `json:"E"`
+	Symbol          string `json:"s"`
+	Mark            string `json:"p"`
+	Index           string `json:"i"`
+	EstimatedSettle string `json:"P"`
+	FundingRate     string `json:"r"`
+	NextFundingTime int64  `json:"T"`
+}
+
+// Tickers of known stablecoins, excluded from every universe. Add more with
+// extraStableCoins in main.go
 var StableCoins = []string{
-	"'BUSD'",
-	"'BITEUR'",
-	"'BITUSD'",
-	"'DAI'",
-	"'EURS'",
-	"'HUSD'",
-	"'LUSD'",
-	"'PAX'",
-	"'RAI'",
-	"'TUSD'",
-	"'USDC'",
-	"'USDD'",
-	"'USDN'",
-	"'USDP'",
-	"'USDT'",
-	"'UST'",
-	"'USTC'",
-	"'VAI'",
-	"'XUSD'",
+	"BUSD",
+	"BITEUR",
+	"BITUSD",
+	"DAI",
+	"EURS",
+	"FDUSD",
+	"FRAX",
+	"GUSD",
+	"HUSD",
+	"LUSD",
+	"PAX",
+	"PYUSD",
+	"RAI",
+	"TUSD",
+	"USDC",
+	"USDD",
+	"USDE",
+	"USDN",
+	"USDP",
+	"USDT",
+	"UST",
+	"USTC",
+	"VAI",
+	"XUSD",
+}
+
+type AssetContract struct {
+	Slug     string
+	CmcId    string
+	Contract string
+}
+
+// Binance contracts of CoinMarketCap assets whose ticker doesn't map to the
+// contract by binanceSymbol, or that share a ticker with another asset. Matched
+// by CMC slug or id, whichever the snapshots table has, see assets.go
+var AssetContracts = []AssetContract{
+	{Slug: "terra-luna-v2", CmcId: "20314", Contract: "LUNA2USDT"},
+	{Slug: "holo", CmcId: "2682", Contract: "HOTUSDT"},
+	{Slug: "green-metaverse-token", CmcId: "18069", Contract: "GMTUSDT"},
+	{Slug: "apecoin-ape", CmcId: "18876", Contract: "APEUSDT"},
 }
 
 var ThousandSymbols = []string{
@@ -64,6 +218,10 @@ var ThousandSymbols = []string{
 	"SHIB",
 }
 
+// Base assets with USDT quarterly delivery contracts on Binance futures. Pairs
+// with quarterlies currently listed in exchangeInfo are added at runtime
+var QuarterlyPairs = []string{"BTC", "ETH"}
+
 var SymbolsBefore2020 = []string{"BTC", "ETH", "BCH"}
 
 var SymbolsBefore2021 = []string{
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+	"github.com/shopspring/decimal"
+)
+
+// API strings as binance sends them, with the digits they must keep
+var apiDecimals = []struct {
+	name  string
+	value string
+}{
+	{"funding rate", "0.00010000"},
+	{"negative funding rate", "-0.00003750"},
+	{"capped funding rate", "0.03000000"},
+	{"btc mark price", "67123.45000000"},
+	{"1000pepe mark price", "0.01234567"},
+	{"1000pepe index price", "0.00987654"},
+	{"pepe price per unit", "0.0000123456789"},
+	{"premium index", "-0.00012345"},
+}
+
+// a funding time binance stamped a few milliseconds after the 08:00 settlement
+var apiFundingTime = time.Date(2024, 3, 1, 8, 0, 0, 3e6, time.UTC).UnixMilli()
+
+// apiSettlement converts a funding record with value as both rate and mark
+func apiSettlement(t *testing.T, value string) data.Settlement {
+	t.Helper()
+	settlement, err := settlementFromApi(data.FundingRateApiResp{Symbol: "BTCUSDT", Time: apiFundingTime, Rate: value, Mark: value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return settlement
+}
+
+func TestSettlementFromApi(t *testing.T) {
+	for _, tt := range apiDecimals {
+		t.Run(tt.name, func(t *testing.T) {
+			settlement := apiSettlement(t, tt.value)
+			// every digit binance sent, trailing zeros included
+			rate := settlement.FundingRate
+			if got := rate.StringFixed(-rate.Exponent()); got != tt.value {
+				t.Errorf("rate digits %s, want %s", got, tt.value)
+			}
+			mark := settlement.MarkPrice
+			if !mark.Valid {
+				t.Fatal("mark is NULL")
+			}
+			if got := mark.Decimal.StringFixed(-mark.Decimal.Exponent()); got != tt.value {
+				t.Errorf("mark digits %s, want %s", got, tt.value)
+			}
+			if want := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC); !settlement.SettlementTime.Equal(want) {
+				t.Errorf("settlement time %s, want %s", settlement.SettlementTime, want)
+			}
+		})
+	}
+}
+
+func TestSettlementFromApiWithoutMark(t *testing.T) {
+	settlement, err := settlementFromApi(data.FundingRateApiResp{Symbol: "BTCUSDT", Time: apiFundingTime, Rate: "0.00010000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settlement.MarkPrice.Valid {
+		t.Errorf("mark %s, want NULL", settlement.MarkPrice.Decimal)
+	}
+}
+
+func TestSettlementFromApiInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		rate string
+		mark string
+	}{
+		{"bad rate with valid mark", "0.0001x", "67123.45000000"},
+		{"empty rate", "", "67123.45000000"},
+		{"bad mark", "0.00010000", "n/a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := settlementFromApi(data.FundingRateApiResp{Symbol: "BTCUSDT", Time: apiFundingTime, Rate: tt.rate, Mark: tt.mark})
+			if err == nil {
+				t.Errorf("rate %q and mark %q parsed without error", tt.rate, tt.mark)
+			}
+		})
+	}
+}
+
+func TestNullDecimalValue(t *testing.T) {
+	var null decimal.NullDecimal
+	value, err := null.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != nil {
+		t.Errorf("NULL valued as %v, want nil", value)
+	}
+	for _, tt := range apiDecimals {
+		t.Run(tt.name, func(t *testing.T) {
+			mark := apiSettlement(t, tt.value).MarkPrice
+			value, err := mark.Value()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, ok := value.(string)
+			if !ok {
+				t.Fatalf("valued as %T, want string", value)
+			}
+			if !decimal.RequireFromString(s).Equal(mark.Decimal) {
+				t.Errorf("valued as %s, want %s", s, tt.value)
+			}
+		})
+	}
+}
+
+// TestNullDecimalCopyEncoding encodes settlements the way CopyFrom sends them
+// to a NUMERIC column and decodes them as postgres would store them
+func TestNullDecimalCopyEncoding(t *testing.T) {
+	m := pgtype.NewMap()
+	var null decimal.NullDecimal
+	buf, err := m.Encode(pgtype.NumericOID, pgtype.BinaryFormatCode, null, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf != nil {
+		t.Errorf("NULL encoded as %v, want nil", buf)
+	}
+	for _, tt := range apiDecimals {
+		t.Run(tt.name, func(t *testing.T) {
+			settlement := apiSettlement(t, tt.value)
+			want := decimal.RequireFromString(tt.value)
+			for _, value := range []any{settlement.FundingRate, settlement.MarkPrice} {
+				buf, err := m.Encode(pgtype.NumericOID, pgtype.BinaryFormatCode, value, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var stored pgtype.Numeric
+				err = m.Scan(pgtype.NumericOID, pgtype.BinaryFormatCode, buf, &stored)
+				if err != nil {
+					t.Fatal(err)
+				}
+				text, err := stored.Value()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !decimal.RequireFromString(text.(string)).Equal(want) {
+					t.Errorf("%T stored as %s, want %s", value, text, tt.value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+)
+
+// Table name in database that will be created by this program and filled with
+// delisting events from exchangeInfo and from gaps in funding history
+var delistingEventsTableName = universeName + "_delisting_events"
+
+// universeMode decides what happens to a symbol that stops settling funding
+// partway through a snapshot week
+type universeMode string
+
+const (
+	// Symbols without a complete week are skipped and the next rank takes
+	// their place
+	universeReplace universeMode = "replace"
+	// Symbols listed when the week starts stay in the universe through the
+	// week with their partial rows, and a universe_exit event records when they
+	// stopped settling
+	universeKeepMembers universeMode = "keep-members"
+)
+
+// Event types stored in delistingEventsTableName
+const (
+	eventDelisting    = "delisting"
+	eventDataGap      = "data_gap"
+	eventUniverseExit = "universe_exit"
+)
+
+// Perpetuals report this deliveryDate in exchangeInfo until they are delisted
+const perpetualDeliveryDate = 4133404800000
+
+// snapshotOf returns the weekly CoinMarketCap snapshot date, the Sunday on or
+// before t, of the week t falls in
+func snapshotOf(t time.Time) time.Time {
+	day := t.UTC().Truncate(24 * time.Hour)
+	return day.AddDate(0, 0, -int(day.Weekday()))
+}
+
+// fundingGap returns the time of the last funding record when a symbol stops
+// settling before the end of period, eg. when it is delisted mid-period
+func fundingGap(fundingRates []data.FundingRateApiResp, period data.Period) (int64, bool) {
+	if len(fundingRates) == 0 || periodInProgress(period) {
+		return 0, false
+	}
+	lastTime := fundingRates[len(fundingRates)-1].Time
+	// a minute of slack for settlements published a few ms late
+	if lastTime < period.End.Add(-fundingInterval(fundingRates)-time.Minute).UnixMilli() {
+		return lastTime, true
+	}
+	return 0, false
+}
+
+// ingestExchangeInfoDelistings creates delistingEventsTableName if it does not
+// exist and records every USDT perpetual exchangeInfo reports as delisted or
+// settling. exchangeInfo only keeps recently delisted contracts, older
+// delistings are found from gaps in funding history
+func ingestExchangeInfoDelistings(ctx context.Context, dbpool *pgxpool.Pool) {
+	// #region Create table "topN_delisting_events" if not exists
+	queryCreateTable := `CREATE TABLE IF NOT EXISTS ` + delistingEventsTableName + `(
+		event_time TIMESTAMPTZ NOT NULL,
+		symbol TEXT,
+		event_type TEXT,
+		snapshot_date DATE,
+
+		PRIMARY KEY (symbol, event_time, event_type)
+		);
+		`
+	_, err := dbpool.Exec(ctx, queryCreateTable)
+	if err != nil {
+		log.Fatalf("Unable to create the '%s' table | %v", delistingEventsTableName, err)
+	} // #endregion
+
+	// #region Build slice of delisting events from exchangeInfo
+	var events []data.DelistingEvent
+	for _, contract := range getExchangeInfo().Symbols {
+		if contract.ContractType != "PERPETUAL" || contract.QuoteAsset != "USDT" {
+			continue
+		}
+		if contract.Status == "TRADING" || contract.DeliveryDate >= perpetualDeliveryDate {
+			continue
+		}
+		events = append(events, data.DelistingEvent{
+			Symbol:       dbSymbol(contract.Symbol),
+			Time:         contract.DeliveryDate,
+			Type:         eventDelisting,
+			SnapshotDate: snapshotOf(time.UnixMilli(contract.DeliveryDate)),
+		})
+	} // #endregion
+
+	recordDelistingEvents(ctx, dbpool, events)
+}
+
+// recordDelistingEvents batch inserts events to delistingEventsTableName,
+// ignoring events already recorded
+func recordDelistingEvents(ctx context.Context, dbpool *pgxpool.Pool, events []data.DelistingEvent) {
+	if len(events) == 0 {
+		return
+	}
+	queryInsertData := `
+		INSERT INTO ` + delistingEventsTableName + `
+		(event_time, symbol, event_type, snapshot_date)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (symbol, event_time, event_type) DO NOTHING;
+		`
+	batch := &pgx.Batch{}
+	for _, event := range events {
+		batch.Queue(queryInsertData, time.UnixMilli(event.Time), event.Symbol, event.Type, event.SnapshotDate)
+	}
+	br := dbpool.SendBatch(ctx, batch)
+	_, err := br.Exec()
+	if err != nil {
+		log.Fatal("Unable to execute statement in batch queue | ", err)
+	}
+	err = br.Close()
+	if err != nil {
+		log.Fatal("Error closing batch | ", err)
+	}
+	log.Printf("Recorded %d delisting events to table %s", len(events), delistingEventsTableName)
+}
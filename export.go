@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Types of exported columns. Timestamps are exported as RFC 3339 UTC strings
+// to CSV and JSON Lines and as TIMESTAMP_MILLIS to Parquet. Decimals keep
+// their exact digits in every format, as UTF8 strings in Parquet since their
+// scale varies by symbol
+type columnKind string
+
+const (
+	kindTimestamp columnKind = "timestamp"
+	kindDate      columnKind = "date"
+	kindText      columnKind = "text"
+	kindInteger   columnKind = "integer"
+	kindDecimal   columnKind = "decimal"
+	kindBoolean   columnKind = "boolean"
+)
+
+// exportColumn is a column of an exported dataset and the SQL expression
+// selecting it from the dataset's source
+type exportColumn struct {
+	name       string
+	kind       columnKind
+	expression string
+}
+
+// exportDataset is a table or view of a universe that can be exported. Column
+// names are stable across releases, new columns are only appended
+type exportDataset struct {
+	name string
+	// FROM clause for universe, aliased so the column expressions resolve
+	source func(universe string) string
+	// column the date filters apply to and rows are ordered by
+	timeColumn string
+	// columns the symbol filter matches, empty if it doesn't apply
+	symbolColumns []string
+	columns       []exportColumn
+}
+
+var exportDatasets = []exportDataset{
+	{
+		name: "funding",
+		source: func(universe string) string {
+			return universe + "_historical_funding_rates f"
+		},
+		timeColumn:    "f.settlement_time",
+		symbolColumns: []string{"f.symbol", "f.binance_symbol"},
+		columns: []exportColumn{
+			{"settlement_time", kindTimestamp, "f.settlement_time"},
+			{"funding_time_raw", kindTimestamp, "f.funding_time_raw"},
+			{"symbol", kindText, "f.symbol"},
+			{"binance_symbol", kindText, "f.binance_symbol"},
+			{"asset_id", kindText, "f.asset_id"},
+			{"rebalance_date", kindDate, "f.rebalance_date"},
+			{"snapshot_date", kindDate, "f.snapshot_date"},
+			{"rank", kindInteger, "f.rank"},
+			{"provisional", kindBoolean, "f.provisional"},
+			{"funding_rate", kindDecimal, "f.funding_rate"},
+			{"mark_price", kindDecimal, "f.mark_price"},
+			{"index_price", kindDecimal, "f.index_price"},
+			{"premium_index", kindDecimal, "f.premium_index"},
+			{"contract_multiplier", kindDecimal, "f.contract_multiplier"},
+			{"mark_price_per_unit", kindDecimal, "f.mark_price_per_unit"},
+			{"index_price_per_unit", kindDecimal, "f.index_price_per_unit"},
+		},
+	},
+	{
+		name: "aggregates",
+		source: func(universe string) string {
+			return universe + "_funding_aggregates a"
+		},
+		timeColumn: "a.settlement_time",
+		columns: []exportColumn{
+			{"settlement_time", kindTimestamp, "a.settlement_time"},
+			{"symbols", kindInteger, "a.symbols"},
+			{"mean_funding_rate", kindDecimal, "a.mean_funding_rate"},
+			{"median_funding_rate", kindDecimal, "a.median_funding_rate"},
+			{"q1_funding_rate", kindDecimal, "a.q1_funding_rate"},
+			{"q3_funding_rate", kindDecimal, "a.q3_funding_rate"},
+			{"min_funding_rate", kindDecimal, "a.min_funding_rate"},
+			{"max_funding_rate", kindDecimal, "a.max_funding_rate"},
+			{"std_funding_rate", kindDecimal, "a.std_funding_rate"},
+			{"mad_funding_rate", kindDecimal, "a.mad_funding_rate"},
+			{"mark_return", kindDecimal, "a.mark_return"},
+			{"mark_return_symbols", kindInteger, "a.mark_return_symbols"},
+		},
+	},
+	{
+		name: "membership",
+		source: func(universe string) string {
+			return universeMembershipTableName + " m WHERE m.universe = '" + universe + "'"
+		},
+		timeColumn:    "m.rebalance_date",
+		symbolColumns: []string{"m.symbol", "m.binance_symbol"},
+		columns: []exportColumn{
+			{"rebalance_date", kindDate, "m.rebalance_date"},
+			{"period_end", kindDate, "m.period_end"},
+			{"snapshot_date", kindDate, "m.snapshot_date"},
+			{"symbol", kindText, "m.symbol"},
+			{"binance_symbol", kindText, "m.binance_symbol"},
+			{"asset_id", kindText, "m.asset_id"},
+			{"rank", kindInteger, "m.rank"},
+			{"provisional", kindBoolean, "m.provisional"},
+		},
+	},
+	{
+		name: "marks",
+		source: func(universe string) string {
+			return markPricesTableName + " p JOIN " + instrumentsTableName + " i ON i.binance_symbol = p.binance_symbol WHERE p.binance_symbol IN (SELECT binance_symbol FROM " + universeMembershipTableName + " WHERE universe = '" + universe + "')"
+		},
+		timeColumn:    "p.mark_time",
+		symbolColumns: []string{"i.symbol", "p.binance_symbol"},
+		columns: []exportColumn{
+			{"mark_time", kindTimestamp, "p.mark_time"},
+			{"binance_symbol", kindText, "p.binance_symbol"},
+			{"mark_price", kindDecimal, "p.mark_price"},
+			{"index_price", kindDecimal, "p.index_price"},
+			{"premium_index", kindDecimal, "p.premium_index"},
+		},
+	},
+}
+
+// exportFilter selects the rows of a dataset to export. Zero values don't filter
+type exportFilter struct {
+	universe string
+	from     time.Time
+	to       time.Time
+	symbol   string
+}
+
+// findExportDataset returns the exportDatasets entry named name
+func findExportDataset(name string) (exportDataset, bool) {
+	for _, dataset := range exportDatasets {
+		if dataset.name == name {
+			return dataset, true
+		}
+	}
+	return exportDataset{}, false
+}
+
+// streamDataset queries the rows of dataset matching filter ordered by time
+// and passes them to write one at a time as text, with timestamps in
+// milliseconds and NULLs as nil, so exports of any size don't load into
+// memory. Returns the number of rows written
+func streamDataset(ctx context.Context, dbpool *pgxpool.Pool, dataset exportDataset, filter exportFilter, write func(values []*string) error) int64 {
+	// #region Build query selecting every column as text
+	var expressions []string
+	for _, column := range dataset.columns {
+		if column.kind == kindTimestamp {
+			expressions = append(expressions, "(EXTRACT(EPOCH FROM "+column.expression+") * 1000)::BIGINT::TEXT")
+		} else {
+			expressions = append(expressions, column.expression+"::TEXT")
+		}
+	}
+	source := dataset.source(filter.universe)
+	var conditions []string
+	var args []any
+	if !filter.from.IsZero() {
+		args = append(args, filter.from)
+		conditions = append(conditions, dataset.timeColumn+" >= $"+strconv.Itoa(len(args)))
+	}
+	if !filter.to.IsZero() {
+		args = append(args, filter.to)
+		conditions = append(conditions, dataset.timeColumn+" < $"+strconv.Itoa(len(args)))
+	}
+	if filter.symbol != "" {
+		if len(dataset.symbolColumns) == 0 {
+			log.Fatalf("The %s dataset can't be filtered by symbol", dataset.name)
+		}
+		args = append(args, filter.symbol)
+		var matches []string
+		for _, symbolColumn := range dataset.symbolColumns {
+			matches = append(matches, symbolColumn+" = $"+strconv.Itoa(len(args)))
+		}
+		conditions = append(conditions, "("+strings.Join(matches, " OR ")+")")
+	}
+	query := `SELECT ` + strings.Join(expressions, ", ") + ` FROM ` + source
+	if len(conditions) > 0 {
+		if strings.Contains(source, " WHERE ") {
+			query += " AND " + strings.Join(conditions, " AND ")
+		} else {
+			query += " WHERE " + strings.Join(conditions, " AND ")
+		}
+	}
+	query += ` ORDER BY ` + dataset.timeColumn // #endregion
+
+	// #region Stream rows to write
+	rows, err := dbpool.Query(ctx, query, args...)
+	if err != nil {
+		log.Fatal("error querying rows | ", err)
+	}
+	defer rows.Close()
+	var count int64
+	values := make([]*string, len(dataset.columns))
+	dests := make([]any, len(dataset.columns))
+	for i := range values {
+		dests[i] = &values[i]
+	}
+	for rows.Next() {
+		err = rows.Scan(dests...)
+		if err != nil {
+			log.Fatal("error scanning row | ", err)
+		}
+		err = write(values)
+		if err != nil {
+			log.Fatal("error writing row | ", err)
+		}
+		count++
+	}
+	if rows.Err() != nil {
+		log.Fatal("error reading rows | ", rows.Err())
+	} // #endregion
+	return count
+}
+
+// exportCommand parses the export command's flags and writes the dataset to
+// the output file, or stdout, in the chosen format
+func exportCommand(ctx context.Context, dbpool *pgxpool.Pool, args []string) {
+	// #region Parse flags
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	datasetName := flags.String("dataset", "funding", "dataset to export: funding, aggregates, membership or marks")
+	format := flags.String("format", "csv", "output format: csv, jsonl or parquet")
+	out := flags.String("out", "-", "output file, - for stdout")
+	universe := flags.String("universe", universeName, "universe to export, eg. top10")
+	from := flags.String("from", "", "first date to export, YYYY-MM-DD")
+	to := flags.String("to", "", "date to export up to, excluded, YYYY-MM-DD")
+	symbol := flags.String("symbol", "", "CMC symbol or binance contract to export")
+	flags.Parse(args)
+	dataset, ok := findExportDataset(*datasetName)
+	if !ok {
+		log.Fatal("Unknown dataset | ", *datasetName)
+	}
+	filter := exportFilter{universe: *universe, symbol: *symbol}
+	var err error
+	if *from != "" {
+		filter.from, err = time.Parse("2006-01-02", *from)
+		if err != nil {
+			log.Fatal("Invalid from date, expected YYYY-MM-DD | ", err)
+		}
+	}
+	if *to != "" {
+		filter.to, err = time.Parse("2006-01-02", *to)
+		if err != nil {
+			log.Fatal("Invalid to date, expected YYYY-MM-DD | ", err)
+		}
+	} // #endregion
+
+	// #region Open output
+	var output io.Writer = os.Stdout
+	if *out != "-" {
+		file, err := os.Create(*out)
+		if err != nil {
+			log.Fatal("Unable to create output file | ", err)
+		}
+		defer file.Close()
+		output = file
+	}
+	buffered := bufio.NewWriter(output)
+	defer buffered.Flush() // #endregion
+
+	start := time.Now()
+	var count int64
+	switch *format {
+	case "csv":
+		count = exportCSV(ctx, dbpool, dataset, filter, buffered)
+	case "jsonl":
+		count = exportJSONLines(ctx, dbpool, dataset, filter, buffered)
+	case "parquet":
+		count = exportParquet(ctx, dbpool, dataset, filter, buffered)
+	default:
+		log.Fatal("Unknown format | ", *format)
+	}
+	log.Printf("Exported %d rows of the %s dataset of universe %s as %s in %v", count, dataset.name, filter.universe, *format, time.Since(start).Round(time.Millisecond))
+}
+
+// formatTimestamp converts a timestamp in milliseconds to RFC 3339 UTC
+func formatTimestamp(millis string) string {
+	ms, err := strconv.ParseInt(millis, 10, 64)
+	if err != nil {
+		log.Fatal("error parsing timestamp | ", err)
+	}
+	return time.UnixMilli(ms).UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// exportCSV writes dataset to w as CSV with a header row. NULLs are empty
+func exportCSV(ctx context.Context, dbpool *pgxpool.Pool, dataset exportDataset, filter exportFilter, w io.Writer) int64 {
+	csvWriter := csv.NewWriter(w)
+	var header []string
+	for _, column := range dataset.columns {
+		header = append(header, column.name)
+	}
+	csvWriter.Write(header)
+	record := make([]string, len(dataset.columns))
+	count := streamDataset(ctx, dbpool, dataset, filter, func(values []*string) error {
+		for i, value := range values {
+			switch {
+			case value == nil:
+				record[i] = ""
+			case dataset.columns[i].kind == kindTimestamp:
+				record[i] = formatTimestamp(*value)
+			default:
+				record[i] = *value
+			}
+		}
+		return csvWriter.Write(record)
+	})
+	csvWriter.Flush()
+	if csvWriter.Error() != nil {
+		log.Fatal("error writing csv | ", csvWriter.Error())
+	}
+	return count
+}
+
+// exportJSONLines writes dataset to w as one JSON object per row, keyed by
+// column name in column order. Numbers are JSON numbers with their exact digits
+func exportJSONLines(ctx context.Context, dbpool *pgxpool.Pool, dataset exportDataset, filter exportFilter, w io.Writer) int64 {
+	return streamDataset(ctx, dbpool, dataset, filter, func(values []*string) error {
+		line := []byte{'{'}
+		for i, value := range values {
+			if i > 0 {
+				line = append(line, ',')
+			}
+			line = strconv.AppendQuote(line, dataset.columns[i].name)
+			line = append(line, ':')
+			switch {
+			case value == nil:
+				line = append(line, "null"...)
+			case dataset.columns[i].kind == kindTimestamp:
+				line = strconv.AppendQuote(line, formatTimestamp(*value))
+			case dataset.columns[i].kind == kindInteger, dataset.columns[i].kind == kindDecimal:
+				line = append(line, *value...)
+			case dataset.columns[i].kind == kindBoolean:
+				line = strconv.AppendBool(line, *value == "true")
+			default:
+				text, err := json.Marshal(*value)
+				if err != nil {
+					return err
+				}
+				line = append(line, text...)
+			}
+		}
+		line = append(line, '}', '\n')
+		_, err := w.Write(line)
+		return err
+	})
+}
+
+// Parquet physical and converted types of each columnKind
+var parquetTypes = map[columnKind]string{
+	kindTimestamp: "type=INT64, convertedtype=TIMESTAMP_MILLIS",
+	kindDate:      "type=INT32, convertedtype=DATE",
+	kindText:      "type=BYTE_ARRAY, convertedtype=UTF8",
+	kindInteger:   "type=INT64",
+	kindDecimal:   "type=BYTE_ARRAY, convertedtype=UTF8",
+	kindBoolean:   "type=BOOLEAN",
+}
+
+// exportParquet writes dataset to w as a snappy compressed Parquet file. Rows
+// are flushed every row group so only one row group is held in memory
+func exportParquet(ctx context.Context, dbpool *pgxpool.Pool, dataset exportDataset, filter exportFilter, w io.Writer) int64 {
+	var schema []string
+	for _, column := range dataset.columns {
+		schema = append(schema, fmt.Sprintf("name=%s, %s, repetitiontype=OPTIONAL", column.name, parquetTypes[column.kind]))
+	}
+	parquetWriter, err := writer.NewCSVWriterFromWriter(schema, w, 4)
+	if err != nil {
+		log.Fatal("Unable to create parquet writer | ", err)
+	}
+	parquetWriter.RowGroupSize = 16 * 1024 * 1024
+	record := make([]*string, len(dataset.columns))
+	count := streamDataset(ctx, dbpool, dataset, filter, func(values []*string) error {
+		for i, value := range values {
+			record[i] = value
+			// dates are days since the unix epoch
+			if value != nil && dataset.columns[i].kind == kindDate {
+				date, err := time.Parse("2006-01-02", *value)
+				if err != nil {
+					return err
+				}
+				days := strconv.FormatInt(date.Unix()/(24*60*60), 10)
+				record[i] = &days
+			}
+		}
+		return parquetWriter.WriteString(record)
+	})
+	err = parquetWriter.WriteStop()
+	if err != nil {
+		log.Fatal("Unable to finish parquet file | ", err)
+	}
+	return count
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+)
+
+// Reasons stored in universeAuditTableName for symbols removed by the
+// membership filters
+const (
+	reasonListingAge      = "listed too recently"
+	reasonLowVolume       = "quote volume below minimum"
+	reasonLowOpenInterest = "open interest below minimum"
+)
+
+// membershipFilter removes thin or newly listed contracts from the universe at
+// each rebalance. Zero values disable a filter
+type membershipFilter struct {
+	// days between the contract's onboardDate and the rebalance
+	minListingDays int
+	// USDT quote volume over the 7 days before the rebalance
+	minQuoteVolume float64
+	// USDT open interest value at the rebalance. Binance only serves the
+	// latest month of open interest, so older rebalances aren't filtered
+	minOpenInterest float64
+
+	// onboard times by binance contract, from exchangeInfo or the first
+	// funding settlement for contracts exchangeInfo no longer lists
+	onboardTimes map[string]int64
+}
+
+// newMembershipFilter returns the membershipFilter configured in main.go with
+// onboard times of the contracts currently in exchangeInfo
+func newMembershipFilter() *membershipFilter {
+	filter := &membershipFilter{
+		minListingDays:  minListingDays,
+		minQuoteVolume:  minQuoteVolume,
+		minOpenInterest: minOpenInterest,
+		onboardTimes:    make(map[string]int64),
+	}
+	if filter.minListingDays > 0 {
+		for _, contract := range getExchangeInfo().Symbols {
+			if contract.OnboardDate > 0 {
+				filter.onboardTimes[contract.Symbol] = contract.OnboardDate
+			}
+		}
+	}
+	return filter
+}
+
+// check returns the audit reason and detail of the first filter candidate
+// fails at rebalance, or false if it passes them all
+func (f *membershipFilter) check(candidate data.Symbol, rebalance time.Time) (string, string, bool) {
+	if f.minListingDays > 0 {
+		onboard, ok := f.onboardTime(candidate.Contract)
+		if ok {
+			days := int(rebalance.Sub(time.UnixMilli(onboard)) / (24 * time.Hour))
+			if days < f.minListingDays {
+				return reasonListingAge, fmt.Sprintf("%d of %d days since onboard", days, f.minListingDays), true
+			}
+		}
+	}
+	if f.minQuoteVolume > 0 {
+		volume, ok := quoteVolume(candidate.Contract, rebalance)
+		if !ok || volume < f.minQuoteVolume {
+			return reasonLowVolume, fmt.Sprintf("%.0f of %.0f USDT over 7 days", volume, f.minQuoteVolume), true
+		}
+	}
+	if f.minOpenInterest > 0 && !rebalance.Before(time.Now().Add(-futuresDataLookback)) {
+		value, ok := openInterestValue(candidate.Contract, rebalance)
+		if !ok || value < f.minOpenInterest {
+			return reasonLowOpenInterest, fmt.Sprintf("%.0f of %.0f USDT", value, f.minOpenInterest), true
+		}
+	}
+	return "", "", false
+}
+
+// onboardTime returns the onboard time of contract, falling back to its first
+// funding settlement for contracts exchangeInfo doesn't list
+func (f *membershipFilter) onboardTime(contract string) (int64, bool) {
+	if onboard, ok := f.onboardTimes[contract]; ok {
+		return onboard, true
+	}
+	url := fmt.Sprintf("https://fapi.binance.com/fapi/v1/fundingRate?symbol=%s&startTime=0&limit=1", contract)
+	var fundingRates []data.FundingRateApiResp
+	if !getJson(url, &fundingRates) || len(fundingRates) == 0 {
+		log.Println("No onboard date for symbol, listing age not filtered | ", contract)
+		return 0, false
+	}
+	// binance funding rate history rate limit: 500/5min/IP
+	time.Sleep(600 * time.Millisecond)
+	f.onboardTimes[contract] = fundingRates[0].Time
+	return fundingRates[0].Time, true
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+)
+
+// Table names in database that will be created by this program and filled with
+// binance futures statistics history for the symbols in fundingTableName
+var openInterestTableName = universeName + "_open_interest_history"
+var globalLongShortTableName = universeName + "_global_long_short_account_ratio"
+var topLongShortTableName = universeName + "_top_long_short_position_ratio"
+var takerVolumeTableName = universeName + "_taker_buy_sell_volume"
+
+// Binance only serves the latest month of /futures/data history. Rebalance
+// periods that start before now - futuresDataLookback are clamped to the
+// available window and periods that end before it are skipped entirely
+const futuresDataLookback = 30 * 24 * time.Hour
+
+// futuresDataset describes one of the binance /futures/data statistics
+// endpoints and the table its history is stored in
+type futuresDataset struct {
+	name       string
+	tableName  string
+	endpoint   string
+	timeColumn string
+	// json keys in the api response, stored in the DECIMAL column at the same index
+	fields  []string
+	columns []string
+}
+
+var futuresDatasets = []futuresDataset{
+	{
+		name:       "open interest",
+		tableName:  openInterestTableName,
+		endpoint:   "openInterestHist",
+		timeColumn: "open_interest_time",
+		fields:     []string{"sumOpenInterest", "sumOpenInterestValue"},
+		columns:    []string{"sum_open_interest", "sum_open_interest_value"},
+	},
+	{
+		name:       "global long/short account ratio",
+		tableName:  globalLongShortTableName,
+		endpoint:   "globalLongShortAccountRatio",
+		timeColumn: "ratio_time",
+		fields:     []string{"longShortRatio", "longAccount", "shortAccount"},
+		columns:    []string{"long_short_ratio", "long_account", "short_account"},
+	},
+	{
+		name:       "top trader long/short position ratio",
+		tableName:  topLongShortTableName,
+		endpoint:   "topLongShortPositionRatio",
+		timeColumn: "ratio_time",
+		// response reuses the account ratio keys for position shares
+		fields:  []string{"longShortRatio", "longAccount", "shortAccount"},
+		columns: []string{"long_short_ratio", "long_position", "short_position"},
+	},
+	{
+		name:       "taker buy/sell volume",
+		tableName:  takerVolumeTableName,
+		endpoint:   "takerlongshortRatio",
+		timeColumn: "volume_time",
+		fields:     []string{"buySellRatio", "buyVol", "sellVol"},
+		columns:    []string{"buy_sell_ratio", "buy_vol", "sell_vol"},
+	},
+}
+
+// ingestFuturesData creates the dataset's table if it does not exist and
+// fills it with the statistic at every funding settlement in fundingTableName
+// within the lookback that doesn't already have data
+func ingestFuturesData(ctx context.Context, dbpool *pgxpool.Pool, dataset futuresDataset) {
+	// #region Create dataset table if not exists
+	var valueColumns string
+	for _, column := range dataset.columns {
+		valueColumns += column + ` DECIMAL NOT NULL,
+		`
+	}
+	queryCreateTable := `CREATE TABLE IF NOT EXISTS ` + dataset.tableName + `(
+		` + dataset.timeColumn + ` TIMESTAMPTZ NOT NULL,
+		symbol TEXT,
+		` + valueColumns + `snapshot_date DATE,
+
+		PRIMARY KEY (symbol, ` + dataset.timeColumn + `)
+		);
+		`
+	_, err := dbpool.Exec(ctx, queryCreateTable)
+	if err != nil {
+		log.Fatalf("Unable to create the '%s' table | %v", dataset.tableName, err)
+	} // #endregion
+
+	// #region Build list of rebalance periods within the lookback window
+	now := time.Now().UTC()
+	lookbackStart := now.Add(-futuresDataLookback)
+	periods := rebalancePeriods(ctx, dbpool, `f.settlement_time >= '`+lookbackStart.Format(time.RFC3339)+`'`)
+	if len(periods) == 0 {
+		log.Printf("No rebalance periods in %s within the %v %s lookback. Skipping %s ingestion", fundingTableName, futuresDataLookback, dataset.endpoint, dataset.name)
+		return
+	} // #endregion
+
+	// Iterate over periods and fill in data for symbols without it
+	for _, period := range periods {
+		// #region Build list of symbols with settlements inside the lookback missing data at rebalance_date
+		symbols := fundingContracts(ctx, dbpool, `rebalance_date = '`+period.Rebalance.Format("2006-01-02")+`' AND settlement_time >= '`+lookbackStart.Format(time.RFC3339)+`' AND NOT EXISTS (SELECT 1 FROM `+dataset.tableName+` d WHERE d.symbol = f.symbol AND d.`+dataset.timeColumn+` = f.settlement_time)`) // #endregion
+
+		// #region Clamp the query window to the data binance still serves
+		startTime := period.Rebalance
+		if startTime.Before(lookbackStart) {
+			// round up to the next funding settlement still inside the lookback
+			startTime = lookbackStart.Truncate(8 * time.Hour).Add(8 * time.Hour)
+			log.Printf("Rebalance %s starts before the %s lookback. Only ingesting %s from %s", period.Rebalance.Format("2006-01-02"), dataset.endpoint, dataset.name, startTime)
+		}
+		endTime := period.End
+		if endTime.After(now) {
+			endTime = now
+		} // #endregion
+
+		// Iterate over list of symbols and poll binance api
+		var queuedData []data.FuturesDataApiResp
+		for _, symbolContract := range symbols {
+			symbol := symbolContract.Symbol
+			// #region Poll api and keep entries at funding settlement times
+			// /futures/data has no 8h period, 4h entries are filtered down to settlements
+			url := fmt.Sprintf("https://fapi.binance.com/futures/data/%s?symbol=%s&period=4h&limit=500&startTime=%v&endTime=%v", dataset.endpoint, symbolContract.Contract, startTime.UnixMilli(), endTime.UnixMilli()-1)
+			res, err := http.Get(url)
+			if err != nil {
+				log.Fatal("http.Get error | ", err)
+			}
+			msg, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				log.Fatal("io.ReadAll error | ", err)
+			}
+			var respInfc []map[string]interface{}
+			err = json.Unmarshal(msg, &respInfc)
+			if err != nil {
+				log.Printf("Skipping entry. Unexpected %s response for symbol at rebalance date | %s %s %s", dataset.endpoint, symbol, period.Rebalance, msg)
+				continue
+			}
+			for _, entry := range respInfc {
+				entryTime := int64(entry["timestamp"].(float64))
+				if entryTime%(8*time.Hour).Milliseconds() != 0 {
+					continue
+				}
+				newData := data.FuturesDataApiResp{Symbol: symbol, Time: entryTime}
+				for _, field := range dataset.fields {
+					switch value := entry[field].(type) {
+					case string:
+						newData.Values = append(newData.Values, value)
+					case float64:
+						newData.Values = append(newData.Values, strconv.FormatFloat(value, 'f', -1, 64))
+					default:
+						log.Fatalf("Unexpected value for %s in %s response | %v", field, dataset.endpoint, entry)
+					}
+				}
+				queuedData = append(queuedData, newData)
+			}
+			// binance /futures/data rate limit: 1000/5min/IP
+			time.Sleep(600 * time.Millisecond) // #endregion
+		}
+
+		// #region Batch insert queuedData to database
+		if len(queuedData) > 0 {
+			placeholders := "$1"
+			for i := 2; i <= len(dataset.columns)+3; i++ {
+				placeholders += ", $" + strconv.Itoa(i)
+			}
+			queryInsertData := `
+				INSERT INTO ` + dataset.tableName + `
+				(` + dataset.timeColumn + `, symbol, ` + strings.Join(dataset.columns, ", ") + `, snapshot_date)
+				VALUES (` + placeholders + `)
+				ON CONFLICT (symbol, ` + dataset.timeColumn + `) DO NOTHING;
+				`
+			batch := &pgx.Batch{}
+			for _, queued := range queuedData {
+				args := []any{time.UnixMilli(queued.Time), queued.Symbol}
+				for _, value := range queued.Values {
+					args = append(args, value)
+				}
+				args = append(args, period.Snapshot)
+				batch.Queue(queryInsertData, args...)
+			}
+			br := dbpool.SendBatch(ctx, batch)
+			_, err = br.Exec()
+			if err != nil {
+				log.Fatal("Unable to execute statement in batch queue | ", err)
+			}
+			log.Printf("Successfully inserted %d rows to table %s at rebalance_date %s", len(queuedData), dataset.tableName, period.Rebalance)
+			err = br.Close()
+			if err != nil {
+				log.Fatal("Error closing batch | ", err)
+			}
+		} // #endregion
+	}
+	log.Printf("%s updates finished", dataset.name)
+}
@@ -2,22 +2,19 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"sort"
-	"strconv"
 	"strings"
 	"time"
 
-	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
 	"github.com/readysetliqd/binance-funding-rates-go/data"
+	"github.com/shopspring/decimal"
 )
 
 // #region Configs
@@ -29,14 +26,68 @@ const snapshotsTableName = "marketcap_snapshots"
 // analyze from every snapshot ie. top 10 by market cap
 const topN = 10
 
+// Strategy selecting the universe from every snapshot, see universe.go. Table
+// names in database are prefixed with its name, eg. "top10" for the default
+// rankSelector{size: topN}. Alternatives:
+//
+//	volumeSelector{size: topN, candidatePool: 100}
+//	openInterestSelector{size: topN, candidatePool: 100}
+//	rankBandSelector{from: 11, to: 50}
+//	fixedSelector{name: "majors", symbols: []string{"BTC", "ETH", "SOL"}}
+var universeSelector UniverseSelector = rankSelector{size: topN}
+
+// Prefix of every table name in database created by this program, eg.
+// "top10" weekly or "top10_daily" on dailySchedule{}
+var universeName = universeSelector.Name() + rebalanceSchedule.Suffix()
+
 // First snapshot entry from CoinMarketCap is April 28th, 2013
 // var dataStartDate = time.Date(2013, 4, 28, 0, 0, 0, 0, time.UTC)
 // Binance futures went live Sep. 13, 2019. First CoinMarketCap snapshot entry after that was the 15th
 var dataStartDate = time.Date(2019, 9, 15, 0, 0, 0, 0, time.UTC)
 
+// Dates the universe is reselected on, see rebalance.go. Each rebalance is
+// ranked by the most recent CoinMarketCap snapshot at or before it. One of
+// dailySchedule{}, weeklySchedule{} (on CMC's Sunday snapshots), monthlySchedule{}
+// or customSchedule{name: "fomc", dates: []time.Time{...}}. Schedules other than
+// weekly suffix universeName, so each schedule's universe is stored apart
+var rebalanceSchedule RebalanceSchedule = weeklySchedule{}
+
 // Table name in database that will be created by this program and filled with
 // historical funding rate data
-var fundingTableName = "top" + strconv.Itoa(topN) + "_historical_funding_rates"
+var fundingTableName = universeName + "_historical_funding_rates"
+
+// Policy deciding whether a symbol's funding records for a snapshot week are
+// complete enough to be included. One of policyStrict, policyMinFraction or
+// policyAllowPartialCurrentWeek, see completeness.go
+const completenessPolicy = policyStrict
+
+// Fraction of a week's settlements a symbol needs under policyMinFraction
+const minCompleteFraction = 0.9
+
+// What happens to symbols that stop settling mid-week. universeReplace skips
+// them for the next rank, universeKeepMembers keeps them through the week with
+// an explicit exit record, see delistings.go
+const universeSelectionMode = universeReplace
+
+// Membership filters applied at every rebalance, see filters.go. Symbols listed
+// fewer than minListingDays days ago, or with less than minQuoteVolume USDT
+// traded over the previous 7 days or minOpenInterest USDT open interest, are
+// skipped for the next rank. 0 disables a filter
+const minListingDays = 0
+const minQuoteVolume = 0.0
+const minOpenInterest = 0.0
+
+// Tickers excluded as stablecoins on top of data.StableCoins, see stablecoins.go
+var extraStableCoins = []string{}
+
+// Symbols whose daily closes stay within stablePriceBand of their median over
+// the 30 days before a rebalance are excluded as stablecoins too. 0 disables
+const stablePriceBand = 0.01
+
+// Store settlements and marks in TimescaleDB hypertables and maintain the
+// per-settlement cross-sectional funding stats as a continuous aggregate, see
+// timescale.go. Requires the timescaledb extension to be available
+const useTimescale = false
 
 // #endregion
 
@@ -46,8 +97,18 @@ func main() {
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
+	command := ""
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
 	// #endregion
 
+	// #region Run local websocket stand-in, doesn't need a database
+	if command == "standin" {
+		serveMarkPriceStandIn(standInAddr)
+		return
+	} // #endregion
+
 	// #region Connect to database
 	ctx := context.Background()
 	connStr := "postgres://" + os.Getenv("DB_USER") + ":" + os.Getenv("DB_PASS") + "@" + os.Getenv("DB_HOST") + ":" + os.Getenv("DB_PORT") + "/" + os.Getenv("DB_NAME")
@@ -61,62 +122,106 @@ func main() {
 	defer dbpool.Close()
 	// #endregion
 
-	// #region Create table "topN_funding_rates" if not exists; initialize date
-	var date time.Time
-	var tableExists bool
-	queryTableExists := `SELECT EXISTS (
-		SELECT 1
-		FROM information_schema.tables
-		WHERE table_name = '` + fundingTableName + `'
-		) AS table_existence;`
-	err = dbpool.QueryRow(ctx, queryTableExists).Scan(&tableExists)
-	if err != nil {
-		log.Fatal("QueryRow failed | ", err)
+	// #region Run command, historical ingestion by default
+	switch command {
+	case "", "ingest":
+		ingest(ctx, dbpool)
+	case "stream":
+		streamMarkPrices(ctx, dbpool)
+	case "serve":
+		serve(ctx, dbpool)
+	case "why":
+		if len(os.Args) < 4 {
+			log.Fatal("Usage: go run . why <symbol> <snapshot date YYYY-MM-DD>")
+		}
+		explainUniverse(ctx, dbpool, os.Args[2], os.Args[3])
+	case "collisions":
+		reportAmbiguousTickers(ctx, dbpool)
+	case "export":
+		exportCommand(ctx, dbpool, os.Args[2:])
+	case "publish":
+		publishCommand(ctx, dbpool, os.Args[2:])
+	default:
+		log.Fatal("Unknown command | ", command)
+	} // #endregion
+}
 
-	}
+// ingest catches the universe's memberships and their funding settlements up
+// to the latest snapshot in snapshotsTableName, backfills mark, index and
+// premium index data and then runs the spot, quarterly basis and futures
+// statistics ingestion. Each call is recorded as a run in ingestionRunsTableName
+func ingest(ctx context.Context, dbpool *pgxpool.Pool) {
+	runId := startIngestionRun(ctx, dbpool)
 
-	if !tableExists {
-		log.Printf("Table %s does not exist. Creating table...", fundingTableName)
-		queryCreateTable := `CREATE TABLE ` + fundingTableName + `(
-			funding_time BIGINT NOT NULL,
-			symbol TEXT,
-			funding_rate DECIMAL NOT NULL,
-			mark_price DECIMAL,
-			snapshot_date DATE,
-			rank INTEGER,
-
-			PRIMARY KEY (symbol, funding_time),
-			FOREIGN KEY (snapshot_date, rank, symbol) REFERENCES ` + snapshotsTableName + `(snapshot_date, rank, symbol)
-			);
-			`
-		_, err = dbpool.Exec(ctx, queryCreateTable)
-		if err != nil {
-			log.Fatalf("Unable to create the '%s' table | %v", fundingTableName, err)
-		}
-		date = dataStartDate
-	} else {
-		log.Printf("Table %s exists. Fetching last entry", fundingTableName)
-		queryLastDate := dbpool.QueryRow(ctx, `SELECT snapshot_date FROM `+fundingTableName+` ORDER BY snapshot_date DESC LIMIT 1`)
-		queryLastDate.Scan(&date)
-		log.Println(date)
-		if date.Before(dataStartDate) { // fixes date when table exists but no entries
-			date = dataStartDate
-		} else {
-			date = date.AddDate(0, 0, 7) // if entries exists, sets date to next weekly snapshot
-		}
-		log.Println("Starting queries at date: ", date)
+	// #region Create the shared tables and the universe's funding view; initialize date
+	createNormalizedTables(ctx, dbpool)
+	migrateLegacyFundingTable(ctx, dbpool)
+	createFundingView(ctx, dbpool)
+	// provisional memberships of a period that was in progress are replaced with a fresh fetch
+	tag, err := dbpool.Exec(ctx, `DELETE FROM `+universeMembershipTableName+` WHERE universe = '`+universeName+`' AND provisional`)
+	if err != nil {
+		log.Fatal("Unable to delete provisional memberships | ", err)
 	}
+	if tag.RowsAffected() > 0 {
+		log.Printf("Deleted %d provisional memberships of universe %s to refetch", tag.RowsAffected(), universeName)
+	}
+	// periods without members are only recorded in the audit table, so the
+	// latest audited period counts too when it had ended when it was audited and
+	// included nobody. Otherwise its members were provisional or never stored
+	// and it's refetched
+	createUniverseAuditTable(ctx, dbpool)
+	var lastMember, lastAudited, date time.Time
+	var lastAuditedDone bool
+	queryLastDate := dbpool.QueryRow(ctx, `SELECT rebalance_date FROM `+universeMembershipTableName+` WHERE universe = '`+universeName+`' ORDER BY rebalance_date DESC LIMIT 1`)
+	queryLastDate.Scan(&lastMember)
+	queryLastAudited := dbpool.QueryRow(ctx, `SELECT rebalance_date, NOT bool_or(included OR provisional) FROM `+universeAuditTableName+` GROUP BY rebalance_date ORDER BY rebalance_date DESC LIMIT 1`)
+	queryLastAudited.Scan(&lastAudited, &lastAuditedDone)
+	switch {
+	case lastAudited.After(lastMember) && lastAuditedDone:
+		date = rebalanceSchedule.Next(lastAudited)
+	case lastAudited.After(lastMember):
+		date = lastAudited // refetch the provisional or unstored period
+	case lastMember.Before(dataStartDate): // fixes date when universe has no entries
+		date = rebalanceSchedule.First(dataStartDate)
+	default:
+		date = rebalanceSchedule.Next(lastMember) // if entries exists, sets date to next rebalance
+	}
+	log.Println("Starting queries at date: ", date)
 	// #endregion
+	if useTimescale {
+		setupTimescale(ctx, dbpool)
+	}
+	createFundingAggregatesTable(ctx, dbpool)
 
-	// #region Make a snapshots slice for snapshot_dates without entries in snapshotsTableName table
-	var snapshots []time.Time
-	snapshotRows, err := dbpool.Query(ctx, `SELECT snapshot_date FROM `+snapshotsTableName+` WHERE snapshot_date >= '`+date.Format("2006-01-02")+`' GROUP BY snapshot_date ORDER BY snapshot_date ASC`)
+	// #region Make a periods slice for rebalance dates without entries, ranked by the latest snapshot before each
+	var latestSnapshot time.Time
+	err = dbpool.QueryRow(ctx, `SELECT MAX(snapshot_date) FROM `+snapshotsTableName).Scan(&latestSnapshot)
 	if err != nil {
-		log.Fatal("error querying rows | ", err)
+		log.Fatal("QueryRow failed | ", err)
 	}
-	snapshots, err = pgx.CollectRows(snapshotRows, pgx.RowTo[time.Time])
-	if err != nil {
-		log.Fatal("error collecting rows | ", err)
+	// a snapshot ranks the week after it, stop there until the next one is scraped
+	until := latestSnapshot.AddDate(0, 0, 7)
+	if time.Now().Before(until) {
+		until = time.Now().UTC()
+	}
+	var periods []data.Period
+	for rebalance := date; !rebalance.IsZero() && rebalance.Before(until); rebalance = rebalanceSchedule.Next(rebalance) {
+		var snapshot time.Time
+		err = dbpool.QueryRow(ctx, `SELECT MAX(snapshot_date) FROM `+snapshotsTableName+` WHERE snapshot_date <= '`+rebalance.Format("2006-01-02")+`'`).Scan(&snapshot)
+		if err != nil || snapshot.IsZero() {
+			log.Println("Skipping rebalance. No snapshot at or before date | ", rebalance)
+			continue
+		}
+		end := rebalanceSchedule.Next(rebalance)
+		if end.IsZero() {
+			break
+		}
+		// policyStrict never stores the period in progress, don't poll it
+		if completenessPolicy == policyStrict && periodInProgress(data.Period{Rebalance: rebalance, End: end}) {
+			log.Println("Skipping rebalance in progress until it ends | ", rebalance)
+			break
+		}
+		periods = append(periods, data.Period{Rebalance: rebalance, End: end, Snapshot: snapshot})
 	}
 	// #endregion
 
@@ -129,6 +234,7 @@ func main() {
 		log.Fatal("http.Get error | ", err)
 	}
 	msg, err = io.ReadAll(res.Body)
+	res.Body.Close()
 	if err != nil {
 		log.Fatal("io.ReadAll error | ", err)
 	}
@@ -140,310 +246,288 @@ func main() {
 	}
 	// #endregion
 
-	// Iterate over slice of snapshots that have yet to be added to database
-	for _, snapshot := range snapshots {
-		// #region Set slice of symbols to check for funding rate history on Binance
-		var symbols []string
-		// HARDCODED WORKAROUND
-		// Binance futures only had 3 markets in 2019, 80 markets in 2020.
-		// Hardcoding the symbols list speeds up the data collection by avoiding
-		// unneccessary API calls especially with higher values for topN const (20+)
-		// Symbols lists made by hand reading through Binance announcements
-		switch {
-		case snapshot.Before(time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)):
-			symbols = data.SymbolsBefore2020
-		case snapshot.Before(time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)):
-			symbols = data.SymbolsBefore2021
-		case snapshot.Before(time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)):
-			symbols = data.SymbolsBefore2022
-		case snapshot.Before(time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)):
-			symbols = data.SymbolsBefore2023
-		case snapshot.Before(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)):
-			symbols = data.SymbolsBefore2024
-		default:
-			var stableCoinsQuery = strings.Join(data.StableCoins, ",")
-			symbolRows, err := dbpool.Query(ctx, `SELECT symbol FROM `+snapshotsTableName+` WHERE snapshot_date = '`+snapshot.Format("2006-01-02")+`' AND symbol NOT IN (`+stableCoinsQuery+`) GROUP BY symbol, rank ORDER BY rank ASC`)
-			if err != nil {
-				log.Fatal("error sending query | ", err)
-			}
-			symbols, err = pgx.CollectRows(symbolRows, pgx.RowTo[string])
-			if err != nil {
-				log.Fatal("error collecting rows | ", err)
-			}
+	ingestExchangeInfoDelistings(ctx, dbpool)
+	filter := newMembershipFilter()
+	stablecoins := newStablecoinClassifier()
 
-			// adjust for binance specific perps listings and remove CMC duplicates
-			seen := make(map[string]bool)
-			symbolsNoDuplicates := []string{}
-			for i, symbol := range symbols {
-				for _, thousandSymbol := range data.ThousandSymbols {
-					if symbol == thousandSymbol {
-						symbols[i] = "1000" + symbol
-					}
-				}
-				if _, ok := seen[symbols[i]]; !ok {
-					seen[symbols[i]] = true
-					symbolsNoDuplicates = append(symbolsNoDuplicates, symbols[i])
-				}
-			}
-			symbols = symbolsNoDuplicates
-		}
-		// #endregion
-
-		// #region Build slice of symbols with their ranks pulled from database
-		var symbolStructs []data.Symbol
-		for _, symbol := range symbols {
-			if strings.Contains(symbol, "1000") {
-				_, symbol, _ = strings.Cut(symbol, "1000")
-			}
-			var rank int64
-			rankRow := dbpool.QueryRow(ctx, `SELECT rank FROM `+snapshotsTableName+` WHERE snapshot_date = '`+snapshot.Format("2006-01-02")+`' AND symbol = '`+symbol+`'`)
-			err = rankRow.Scan(&rank)
-			if err != nil {
-				if strings.Contains(err.Error(), "no rows in result set") {
-					// Handle edge case where IOTA on binance is MIOTA on CMC
-					if symbol == "IOTA" {
-						symbol = "MIOTA"
-						rankRow := dbpool.QueryRow(ctx, `SELECT rank FROM `+snapshotsTableName+` WHERE snapshot_date = '`+snapshot.Format("2006-01-02")+`' AND symbol = '`+symbol+`'`)
-						err = rankRow.Scan(&rank)
-						if err != nil {
-							if strings.Contains(err.Error(), "no rows in result set") {
-								continue
-							} else {
-								log.Fatal("Error scanning row | ", err, symbol)
-							}
-						}
-					} else {
-						continue
-					}
-				} else {
-					log.Fatal("Error scanning row | ", err, symbol)
-				}
-			}
-			var newSymbol = data.Symbol{
-				Symbol: symbol,
-				Rank:   rank,
-			}
-			if newSymbol.Rank != 0 {
-				symbolStructs = append(symbolStructs, newSymbol)
-			}
-		}
-		sort.Slice(symbolStructs[:], func(i, j int) bool {
-			return symbolStructs[i].Rank < symbolStructs[j].Rank
-		}) // #endregion
+	// Iterate over slice of rebalance periods that have yet to be added to database
+	for _, period := range periods {
+		// #region Build slice of CMC ranked candidates and order them with universeSelector
+		symbolStructs, queuedAudit := rankedCandidates(ctx, dbpool, period.Snapshot, stablecoins)
+		symbolStructs, selectorAudit := universeSelector.Order(ctx, period.Rebalance, symbolStructs)
+		queuedAudit = append(queuedAudit, selectorAudit...) // #endregion
 
 		// #region Iterate over symbols and poll binance fundingRate API. Add...
-		// funding history for coin if data is complete between this snapshot
-		// and the next until list is exhausted or topN coins with complete data
+		// funding history for coin if data is complete between this rebalance
+		// and the next until list is exhausted or universe size coins with complete data
 		// is reached, whichever comes first
 		var queuedApiResp []data.FundingRateApiResp
+		var queuedMembers []data.Symbol
+		var queuedEvents []data.DelistingEvent
 		countCoinsApiResp := 0
-		for _, symbol := range symbolStructs {
-			url = fmt.Sprintf("https://fapi.binance.com/fapi/v1/fundingRate?symbol=%sUSDT&startTime=%v&endTime=%v", symbol.Symbol, snapshot.UnixMilli(), snapshot.AddDate(0, 0, 7).UnixMilli()-1)
-			res, err := http.Get(url)
-			if err != nil {
-				log.Println("http.Get error | ", err)
+		for i, symbol := range symbolStructs {
+			// settlements another universe already stored for the period aren't refetched
+			fundingRates, stored := storedFundingRates(ctx, dbpool, symbol.Contract, period)
+			if !stored {
+				fundingRates = getFundingRates(symbol.Contract, period.Rebalance, period.End)
 			}
-			defer res.Body.Close()
-			msg, err = io.ReadAll(res.Body)
-			if err != nil {
-				log.Fatal("io.ReadAll error | ", err)
+			member := isComplete(fundingRates, period)
+			interval := fundingInterval(fundingRates)
+			// listed when the period started, kept through the period even if it stops settling
+			if universeSelectionMode == universeKeepMembers && len(fundingRates) > 0 && fundingRates[0].Time < period.Rebalance.Add(interval).UnixMilli() {
+				member = true
+			}
+			// stablecoins missing from the known list, thin or newly listed
+			// contracts are skipped for the next rank
+			var filterReason, filterDetail string
+			if member {
+				if detail, stable := stablecoins.priceStable(symbol, period.Rebalance); stable {
+					filterReason, filterDetail = reasonStablecoin, detail
+				} else if reason, detail, filtered := filter.check(symbol, period.Rebalance); filtered {
+					filterReason, filterDetail = reason, detail
+				}
+				member = filterReason == ""
+			}
+			if lastTime, ok := fundingGap(fundingRates, period); ok {
+				queuedEvents = append(queuedEvents, data.DelistingEvent{Symbol: symbol.Symbol, Time: lastTime, Type: eventDataGap, SnapshotDate: period.Snapshot})
+				if member {
+					queuedEvents = append(queuedEvents, data.DelistingEvent{Symbol: symbol.Symbol, Time: lastTime, Type: eventUniverseExit, SnapshotDate: period.Snapshot})
+				}
 			}
-			var fundingRates []data.FundingRateApiResp
-			json.Unmarshal(msg, &fundingRates)
-			if len(fundingRates) < 21 {
+			audit := newAuditRecord(symbol, reasonIncluded, fmt.Sprintf("%d of %d records", len(fundingRates), periodSettlements(period, interval)))
+			if len(fundingRates) == 0 {
+				audit.Reason, audit.Detail = reasonNotListed, ""
+			} else if filterReason != "" {
+				audit.Reason, audit.Detail = filterReason, filterDetail
+			} else if !member {
+				audit.Reason = reasonIncomplete
+			}
+			audit.Included = member
+			queuedAudit = append(queuedAudit, audit)
+			if !member {
 				continue
 			} else {
 				countCoinsApiResp += 1
+				queuedMembers = append(queuedMembers, symbol)
 				queuedApiResp = append(queuedApiResp, fundingRates...)
 			}
-			// Break loop if topN number of coins queued
-			if countCoinsApiResp >= topN {
+			// Break loop if universe size number of coins queued
+			if countCoinsApiResp >= universeSelector.Size() {
+				for _, remaining := range symbolStructs[i+1:] {
+					queuedAudit = append(queuedAudit, newAuditRecord(remaining, reasonTopNReached, ""))
+				}
 				break
 			}
-			// binance funding rate history rate limit: 500/5min/IP
-			time.Sleep(600 * time.Millisecond)
-		} // #endregion
+		}
+		recordDelistingEvents(ctx, dbpool, queuedEvents) // #endregion
 
-		// #region Iterate over APIresps and build slice of rows to batch insert to db
-		var queuedRows []data.Row
+		// #region Iterate over members and APIresps and build slices of instruments, memberships and settlements to batch insert to db
+		var queuedInstruments []data.Instrument
+		var queuedMemberships []data.Membership
+		for _, member := range queuedMembers {
+			queuedInstruments = append(queuedInstruments, data.Instrument{
+				BinanceSymbol: member.Contract,
+				Symbol:        member.Symbol,
+				AssetId:       member.AssetId,
+				// mark prices are per contract, eg. per 1000 PEPE
+				ContractMultiplier: contractMultiplier(member.Contract),
+			})
+			queuedMemberships = append(queuedMemberships, data.Membership{
+				Universe:      universeName,
+				RebalanceDate: period.Rebalance,
+				PeriodEnd:     period.End,
+				SnapshotDate:  period.Snapshot,
+				AssetId:       member.AssetId,
+				Symbol:        member.Symbol,
+				BinanceSymbol: member.Contract,
+				Rank:          member.Rank,
+				Provisional:   periodInProgress(period),
+			})
+		}
+		var queuedSettlements []data.Settlement
 		for _, apiResp := range queuedApiResp {
-			rate, err := strconv.ParseFloat(apiResp.Rate, 64)
-			var mark sql.NullFloat64
-			if apiResp.Mark == "" {
-				mark.Float64 = 0.0
-				mark.Valid = false
-			} else {
-				mark.Float64, err = strconv.ParseFloat(apiResp.Mark, 64)
-				mark.Valid = true
-			}
+			newSettlement, err := settlementFromApi(apiResp)
 			if err != nil {
-				log.Fatal("ParseFloat error | ", err)
+				log.Fatal("Unable to parse funding record | ", err)
 			}
-
-			symbol, _, ok := strings.Cut(apiResp.Symbol, "USDT")
-			if !ok {
-				log.Fatal("Error cutting USDT from string | ", symbol)
-			}
-			if strings.Contains(symbol, "1000") {
-				_, symbol, _ = strings.Cut(symbol, "1000")
-			}
-
-			var rank int64
-			found := false
-			for _, symbolStruct := range symbolStructs {
-				if symbol == symbolStruct.Symbol {
-					rank = symbolStruct.Rank
-					found = true
-					break
-				}
-			}
-			if !found {
-				if symbol == "IOTA" {
-					symbol = "MIOTA"
-					for _, symbolStruct := range symbolStructs {
-						if symbol == symbolStruct.Symbol {
-							rank = symbolStruct.Rank
-							break
-						}
-					}
-				} else {
-					log.Fatal("Symbol not found in slice | ", symbol)
-				}
-			}
-			newRow := data.Row{
-				FundingTime:  apiResp.Time,
-				Symbol:       symbol,
-				FundingRate:  rate,
-				MarkPrice:    mark,
-				SnapshotDate: snapshot,
-				Rank:         rank,
-			}
-			queuedRows = append(queuedRows, newRow)
+			queuedSettlements = append(queuedSettlements, newSettlement)
 		} // #endregion
 
-		// #region Batch insert queuedRows to database
-		queryInsertData := `
-			INSERT INTO ` + fundingTableName + `
-			(funding_time, symbol, funding_rate, mark_price, snapshot_date, rank)
-			VALUES ($1, $2, $3, $4, $5, $6);
-			`
-		batch := &pgx.Batch{}
-		for _, row := range queuedRows {
-			batch.Queue(queryInsertData, row.FundingTime, row.Symbol, row.FundingRate, row.MarkPrice, row.SnapshotDate, row.Rank)
+		// #region Copy queued audit records, instruments, settlements and memberships to database in one transaction
+		var instrumentRows, settlementRows, membershipRows [][]any
+		for _, instrument := range queuedInstruments {
+			instrumentRows = append(instrumentRows, []any{instrument.BinanceSymbol, instrument.Symbol, nullIfEmpty(instrument.AssetId), instrument.ContractMultiplier})
+		}
+		for _, settlement := range queuedSettlements {
+			settlementRows = append(settlementRows, []any{settlement.BinanceSymbol, settlement.FundingTime, settlement.SettlementTime, settlement.FundingRate, settlement.MarkPrice, runId})
 		}
-		br := dbpool.SendBatch(ctx, batch)
-		_, err := br.Exec()
+		for _, membership := range queuedMemberships {
+			membershipRows = append(membershipRows, []any{membership.Universe, membership.RebalanceDate, membership.PeriodEnd, membership.SnapshotDate, nullIfEmpty(membership.AssetId), membership.Symbol, membership.BinanceSymbol, membership.Rank, membership.Provisional, runId})
+		}
+		tx, err := dbpool.Begin(ctx)
 		if err != nil {
-			log.Fatal("Unable to execute statement in batch queue | ", err)
+			log.Fatal("Unable to begin transaction | ", err)
 		}
-		log.Printf("Successfully inserted %d rows to table %s at snapshot_date %s", len(queuedRows), fundingTableName, snapshot)
-
-		err = br.Close()
+		recordUniverseAudit(ctx, tx, period, queuedAudit)
+		copyMerge(ctx, tx, instrumentsTableName,
+			[]string{"binance_symbol", "symbol", "asset_id", "contract_multiplier"},
+			[]string{"binance_symbol"},
+			`DO UPDATE SET symbol = EXCLUDED.symbol, asset_id = COALESCE(EXCLUDED.asset_id, `+instrumentsTableName+`.asset_id)`,
+			instrumentRows)
+		// settlements other universes stored are shared rather than duplicated
+		copyMerge(ctx, tx, fundingSettlementsTableName,
+			[]string{"binance_symbol", "funding_time", "settlement_time", "funding_rate", "mark_price", "run_id"},
+			[]string{"binance_symbol", "settlement_time"},
+			`DO UPDATE SET mark_price = COALESCE(EXCLUDED.mark_price, `+fundingSettlementsTableName+`.mark_price)`,
+			settlementRows)
+		copyMerge(ctx, tx, universeMembershipTableName,
+			[]string{"universe", "rebalance_date", "period_end", "snapshot_date", "asset_id", "symbol", "binance_symbol", "rank", "provisional", "run_id"},
+			[]string{"universe", "rebalance_date", "binance_symbol"},
+			`DO NOTHING`,
+			membershipRows)
+		err = tx.Commit(ctx)
 		if err != nil {
-			log.Fatal("Error closing batch | ", err)
-		} // #endregion
+			log.Fatal("Unable to commit transaction | ", err)
+		}
+		log.Printf("Successfully inserted %d settlements of %d members of universe %s at rebalance_date %s ranked by snapshot_date %s", len(queuedSettlements), len(queuedMemberships), universeName, period.Rebalance, period.Snapshot) // #endregion
+		updateFundingAggregates(ctx, dbpool, period)
+		if useTimescale {
+			syncUniverseSettlements(ctx, dbpool, period)
+		}
 	}
 	log.Printf("Insertions to table %s have caught up to entries in table %s", fundingTableName, snapshotsTableName)
 
-	// #region Build list of snapshot_dates with incomplete mark price data
-	snapshotRows, err = dbpool.Query(ctx, `SELECT snapshot_date FROM `+fundingTableName+` WHERE mark_price IS NULL GROUP BY snapshot_date ORDER BY snapshot_date ASC`)
-	if err != nil {
-		log.Fatal("error querying rows | ", err)
+	ingestMarkPrices(ctx, dbpool, runId)
+
+	ingestSpotPrices(ctx, dbpool)
+
+	ingestQuarterlyBasis(ctx, dbpool)
+
+	for _, dataset := range futuresDatasets {
+		ingestFuturesData(ctx, dbpool, dataset)
 	}
-	snapshots, err = pgx.CollectRows(snapshotRows, pgx.RowTo[time.Time])
-	if err != nil {
-		log.Fatal("error collecting rows | ", err)
-	} // #endregion
 
-	// Iterate over snapshots and find symbols without mark_price data
-	for _, snapshot := range snapshots {
-		// #region Build list of symbols without mark_price data at snapshot_date
-		var symbols []string
-		symbolRows, err := dbpool.Query(ctx, `SELECT symbol FROM `+fundingTableName+` WHERE snapshot_date = '`+snapshot.Format("2006-01-02")+`' AND mark_price IS NULL GROUP BY symbol`)
+	finishIngestionRun(ctx, dbpool, runId)
+}
+
+// Most records binance's fundingRate API returns per request
+const fundingRateLimit = 1000
+
+// getFundingRates polls the binance fundingRate API for the funding records of
+// contract in [start, end), paging on the last fundingTime since 1h and 4h
+// contracts settle more often than one request returns. Every request is
+// followed by a pause so no caller exceeds the rate limit. Symbols binance
+// doesn't list return none
+func getFundingRates(contract string, start time.Time, end time.Time) []data.FundingRateApiResp {
+	var fundingRates []data.FundingRateApiResp
+	for start.Before(end) {
+		url := fmt.Sprintf("https://fapi.binance.com/fapi/v1/fundingRate?symbol=%s&limit=%d&startTime=%v&endTime=%v", contract, fundingRateLimit, start.UnixMilli(), end.UnixMilli()-1)
+		res, err := http.Get(url)
 		if err != nil {
-			log.Fatal("error querying rows | ", err)
+			log.Fatal("http.Get error | ", err)
 		}
-		symbols, err = pgx.CollectRows(symbolRows, pgx.RowTo[string])
+		msg, err := io.ReadAll(res.Body)
+		res.Body.Close()
 		if err != nil {
-			log.Fatal("error collecting rows | ", err)
-		} // #endregion
+			log.Fatal("io.ReadAll error | ", err)
+		}
+		// binance funding rate history rate limit: 500/5min/IP
+		time.Sleep(600 * time.Millisecond)
+		var page []data.FundingRateApiResp
+		json.Unmarshal(msg, &page)
+		fundingRates = append(fundingRates, page...)
+		if len(page) < fundingRateLimit {
+			break
+		}
+		start = time.UnixMilli(page[len(page)-1].Time + 1)
+	}
+	return fundingRates
+}
 
-		// Iterate over list of symbols and fill in mark_price data from api
-		var queuedMarks []data.MarkApiResp
-		for _, symbol := range symbols {
-			// #region build api url and poll it with http.Get
-			if symbol == "MIOTA" {
-				symbol = "IOTA"
-			}
-			symbol = symbol + "USDT"
-			url = fmt.Sprintf("https://fapi.binance.com/fapi/v1/markPriceKlines?symbol=%s&interval=8h&limit=21&startTime=%v&endTime=%v", symbol, snapshot.UnixMilli(), snapshot.AddDate(0, 0, 7).UnixMilli()-1)
-			res, err = http.Get(url)
-			if err != nil {
-				log.Fatal("http.Get error | ", err)
-			}
-			defer res.Body.Close()
-			msg, err = io.ReadAll(res.Body)
-			if err != nil {
-				log.Fatal("io.ReadAll error | ", err)
-			} // #endregion
+// settlementFromApi converts a fundingRate API record to a settlement, keeping
+// the rate and mark price as the exact decimals binance sends. Records without
+// a markPrice have a NULL mark
+func settlementFromApi(apiResp data.FundingRateApiResp) (data.Settlement, error) {
+	rate, err := decimal.NewFromString(apiResp.Rate)
+	if err != nil {
+		return data.Settlement{}, fmt.Errorf("%s fundingRate %q | %w", apiResp.Symbol, apiResp.Rate, err)
+	}
+	var mark decimal.NullDecimal
+	if apiResp.Mark != "" {
+		mark.Decimal, err = decimal.NewFromString(apiResp.Mark)
+		if err != nil {
+			return data.Settlement{}, fmt.Errorf("%s markPrice %q | %w", apiResp.Symbol, apiResp.Mark, err)
+		}
+		mark.Valid = true
+	}
+	return data.Settlement{
+		BinanceSymbol:  apiResp.Symbol,
+		FundingTime:    time.UnixMilli(apiResp.Time),
+		SettlementTime: settlementTime(apiResp.Time),
+		FundingRate:    rate,
+		MarkPrice:      mark,
+	}, nil
+}
 
-			// #region Unmarshal api response to slice of interface slices
-			var respInfc [][]interface{}
-			err = json.Unmarshal(msg, &respInfc)
-			if err != nil {
-				log.Fatal("json.Unmarshal error | ", err)
-			}
-			if len(respInfc) < 21 {
-				log.Println("Skipping entry. Not enough data for symbol at snapshot date | ", symbol, snapshot)
-				continue
-			} // #endregion
-
-			// Iterate over api response slice and build slice to queue data for batch insert
-			for _, markResp := range respInfc {
-				// #region Convert symbol to db format and add mark data to slice of queuedMarks
-				symbol, _, ok := strings.Cut(symbol, "USDT")
-				if !ok {
-					log.Fatal("Error cutting USDT from string, USDT not found | ", symbol)
-				}
-				if strings.Contains(symbol, "1000") {
-					_, symbol, _ = strings.Cut(symbol, "1000")
-				}
-				mark, err := strconv.ParseFloat(markResp[1].(string), 64)
-				if err != nil {
-					log.Fatal("error parsing float | ", err)
-				}
-				newMark := data.MarkApiResp{Symbol: symbol, Time: int64(markResp[0].(float64)), Mark: mark}
-				queuedMarks = append(queuedMarks, newMark) // #endregion
-			}
-			// Sleep to prevent rate limiting
-			time.Sleep(time.Millisecond * 25) // from binance api: weight = 1 for limit [1,100]. 2400 weight/min = 40 queries/sec
+// getKlines polls one of the binance kline endpoints (futures markPriceKlines,
+// indexPriceKlines, premiumIndexKlines, continuousKlines or spot klines) for
+// the 8h klines opening in [start, end). query selects the market, eg.
+// "symbol=BTCUSDT" or "pair=BTCUSDT". Returns an error if the response isn't a
+// list of klines, eg. when binance doesn't list the symbol
+func getKlines(endpoint string, query string, start time.Time, end time.Time) ([][]interface{}, error) {
+	return getKlinesInterval(endpoint, query, 8*time.Hour, start, end)
+}
+
+// futuresWeightInterval is the wait per unit of request weight that keeps
+// within binance futures' 2400 weight/min
+const futuresWeightInterval = time.Minute / 2400
+
+// klinesWeight returns the request weight getKlinesInterval spends on the
+// klines of interval opening in [start, end). From binance api: weight = 1 for
+// limit [1,100), 2 for [100,500), 5 for [500,1000] and 10 above
+func klinesWeight(interval time.Duration, start time.Time, end time.Time) int {
+	weight := 0
+	for klines := int(end.Sub(start)/interval) + 1; klines > 0; klines -= 1500 {
+		switch limit := min(klines, 1500); {
+		case limit < 100:
+			weight += 1
+		case limit < 500:
+			weight += 2
+		case limit <= 1000:
+			weight += 5
+		default:
+			weight += 10
 		}
-		// #region Iterate over slice of queuedMarks and batch update database
-		if len(queuedMarks) > 0 {
-			// note dividing funding time by 100 for comparison because some data
-			// from binance can be several milliseconds later than the 8hr interval
-			queryUpdateMark := `
-				UPDATE ` + fundingTableName + ` 
-				SET mark_price = $1
-				WHERE funding_time / 100 = $2
-				AND symbol = $3;
-			`
-			batch := &pgx.Batch{}
-			for _, queuedMark := range queuedMarks {
-				mark := fmt.Sprintf("%f", queuedMark.Mark)
-				batch.Queue(queryUpdateMark, mark, queuedMark.Time/100, queuedMark.Symbol)
-			}
-			br := dbpool.SendBatch(ctx, batch)
-			_, err = br.Exec()
-			if err != nil {
-				log.Fatal("error sending batch | ", err)
-			}
-			log.Printf("Batch updated mark_price for %v rows on %s table at snapshot date %s", len(queuedMarks), fundingTableName, snapshot)
-			err = br.Close()
-			if err != nil {
-				log.Fatal("error closing batch | ", err)
-			} // #endregion
+	}
+	return weight
+}
+
+// getKlinesInterval is getKlines for klines of a whole number of hours,
+// paging through windows longer than binance's 1500 klines per request
+func getKlinesInterval(endpoint string, query string, interval time.Duration, start time.Time, end time.Time) ([][]interface{}, error) {
+	var klines [][]interface{}
+	for start.Before(end) {
+		limit := min(int(end.Sub(start)/interval)+1, 1500)
+		url := fmt.Sprintf("%s?%s&interval=%dh&limit=%d&startTime=%v&endTime=%v", endpoint, query, int(interval.Hours()), limit, start.UnixMilli(), end.UnixMilli()-1)
+		res, err := http.Get(url)
+		if err != nil {
+			log.Fatal("http.Get error | ", err)
+		}
+		msg, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			log.Fatal("io.ReadAll error | ", err)
+		}
+		var respInfc [][]interface{}
+		err = json.Unmarshal(msg, &respInfc)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s | %w", query, msg, err)
+		}
+		klines = append(klines, respInfc...)
+		if len(respInfc) < limit {
+			break
 		}
+		start = time.UnixMilli(int64(respInfc[len(respInfc)-1][0].(float64))).Add(interval)
 	}
-	log.Println("Mark price updates finished")
+	return klines, nil
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+	"github.com/shopspring/decimal"
+)
+
+// Kline interval the mark, index and premium index backfill requests. Each
+// settlement is the open of exactly one hourly kline whatever the symbol's
+// interval is, see settlementTime
+const markKlineInterval = time.Hour
+
+// ingestMarkPrices backfills mark, index and premium index klines at every
+// settlement in fundingTableName missing them. Each settlement is aligned to
+// the kline opening at its settlement_time, settlements without a kline are
+// reported and retried by the next run. Settlements with the markPrice binance
+// sends with funding rates keep it and only need index and premium data.
+// Stored marks are tagged with the ingestion run runId
+func ingestMarkPrices(ctx context.Context, dbpool *pgxpool.Pool, runId int64) {
+	// Build list of rebalance periods with incomplete mark, index or premium data
+	periods := rebalancePeriods(ctx, dbpool, `mark_price IS NULL OR index_price IS NULL OR premium_index IS NULL`)
+
+	// Iterate over periods and find symbols without mark_price, index_price or premium_index data
+	unmatchedTotal := 0
+	for _, period := range periods {
+		// #region Build list of symbols without mark, index or premium data at rebalance_date
+		symbols := fundingContracts(ctx, dbpool, `rebalance_date = '`+period.Rebalance.Format("2006-01-02")+`' AND (mark_price IS NULL OR index_price IS NULL OR premium_index IS NULL)`) // #endregion
+
+		// Iterate over list of symbols and fill in mark, index and premium data from api
+		var queuedMarks []data.MarkApiResp
+		for _, symbolContract := range symbols {
+			symbol := symbolContract.Contract
+			settlements := missingMarkSettlements(ctx, dbpool, symbol, period)
+			if len(settlements) == 0 {
+				continue
+			}
+			start := settlements[0].SettlementTime
+			end := settlements[len(settlements)-1].SettlementTime.Add(markKlineInterval)
+
+			// #region Poll mark, index and premium index kline apis and key them by open time
+			var marks map[int64]decimal.Decimal
+			requests := 2
+			for _, settlement := range settlements {
+				if !settlement.HasMark {
+					marks = klineOpens("https://fapi.binance.com/fapi/v1/markPriceKlines", "symbol="+symbol, start, end)
+					requests++
+					break
+				}
+			}
+			// indexPriceKlines is queried by pair rather than symbol
+			indexes := klineOpens("https://fapi.binance.com/fapi/v1/indexPriceKlines", "pair="+symbol, start, end)
+			premiums := klineOpens("https://fapi.binance.com/fapi/v1/premiumIndexKlines", "symbol="+symbol, start, end) // #endregion
+
+			// #region Align each settlement to the kline opening at its settlement time
+			var unmatched []string
+			for _, settlement := range settlements {
+				settlementTime := settlement.SettlementTime.UnixMilli()
+				newMark := data.MarkApiResp{Symbol: symbol, Time: settlementTime}
+				if mark, ok := marks[settlementTime]; ok {
+					newMark.Mark = decimal.NewNullDecimal(mark)
+				}
+				if index, ok := indexes[settlementTime]; ok {
+					newMark.Index = decimal.NewNullDecimal(index)
+				}
+				if premium, ok := premiums[settlementTime]; ok {
+					newMark.Premium = decimal.NewNullDecimal(premium)
+				}
+				if (!settlement.HasMark && !newMark.Mark.Valid) || !newMark.Index.Valid || !newMark.Premium.Valid {
+					unmatched = append(unmatched, settlement.SettlementTime.Format(time.RFC3339))
+				}
+				if newMark.Mark.Valid || newMark.Index.Valid || newMark.Premium.Valid {
+					queuedMarks = append(queuedMarks, newMark)
+				}
+			}
+			if len(unmatched) > 0 {
+				unmatchedTotal += len(unmatched)
+				log.Printf("No mark, index or premium kline for %d of %d settlements of %s at rebalance date %s | %v", len(unmatched), len(settlements), symbol, period.Rebalance.Format("2006-01-02"), unmatched)
+			} // #endregion
+
+			// Sleep to prevent rate limiting. A week of hourly klines is weight 2
+			// per request and a month is weight 5
+			time.Sleep(time.Duration(requests*klinesWeight(markKlineInterval, start, end)) * futuresWeightInterval)
+		}
+		// #region Copy queuedMarks to database and merge them with the stored marks
+		if len(queuedMarks) > 0 {
+			var markRows [][]any
+			for _, queuedMark := range queuedMarks {
+				markRows = append(markRows, []any{queuedMark.Symbol, time.UnixMilli(queuedMark.Time), queuedMark.Mark, queuedMark.Index, queuedMark.Premium, runId})
+			}
+			tx, err := dbpool.Begin(ctx)
+			if err != nil {
+				log.Fatal("Unable to begin transaction | ", err)
+			}
+			// marks are stored by settlement time and shared by every universe,
+			// the funding view prefers the markPrice sent with funding rates
+			merged := copyMerge(ctx, tx, markPricesTableName,
+				[]string{"binance_symbol", "mark_time", "mark_price", "index_price", "premium_index", "run_id"},
+				[]string{"binance_symbol", "mark_time"},
+				`DO UPDATE SET
+					mark_price = COALESCE(EXCLUDED.mark_price, `+markPricesTableName+`.mark_price),
+					index_price = COALESCE(EXCLUDED.index_price, `+markPricesTableName+`.index_price),
+					premium_index = COALESCE(EXCLUDED.premium_index, `+markPricesTableName+`.premium_index),
+					run_id = EXCLUDED.run_id`,
+				markRows)
+			err = tx.Commit(ctx)
+			if err != nil {
+				log.Fatal("Unable to commit transaction | ", err)
+			}
+			log.Printf("Upserted %v mark, index and premium index klines to table %s at rebalance date %s", merged, markPricesTableName, period.Rebalance)
+			// mark returns of the period change with its marks
+			updateFundingAggregates(ctx, dbpool, period)
+		} // #endregion
+	}
+	if unmatchedTotal > 0 {
+		log.Printf("Mark, index and premium index updates finished. %d settlements had no kline and will be retried next run", unmatchedTotal)
+		return
+	}
+	log.Println("Mark, index and premium index updates finished")
+}
+
+// markSettlement is a settlement of fundingTableName missing mark, index or
+// premium index data
+type markSettlement struct {
+	SettlementTime time.Time
+	HasMark        bool
+}
+
+// missingMarkSettlements returns the settlements of contract in period missing
+// mark, index or premium index data, ordered by settlement time
+func missingMarkSettlements(ctx context.Context, dbpool *pgxpool.Pool, contract string, period data.Period) []markSettlement {
+	settlementRows, err := dbpool.Query(ctx, `
+		SELECT settlement_time, mark_price IS NOT NULL
+		FROM `+fundingTableName+`
+		WHERE binance_symbol = $1 AND rebalance_date = $2
+		AND (mark_price IS NULL OR index_price IS NULL OR premium_index IS NULL)
+		ORDER BY settlement_time ASC`, contract, period.Rebalance)
+	if err != nil {
+		log.Fatal("error querying rows | ", err)
+	}
+	settlements, err := pgx.CollectRows(settlementRows, pgx.RowToStructByPos[markSettlement])
+	if err != nil {
+		log.Fatal("error collecting rows | ", err)
+	}
+	return settlements
+}
+
+// klineOpens returns the open price of each hourly kline of endpoint opening in
+// [start, end) keyed by open time in milliseconds. Symbols binance doesn't serve return none
+func klineOpens(endpoint string, query string, start time.Time, end time.Time) map[int64]decimal.Decimal {
+	opens := make(map[int64]decimal.Decimal)
+	klines, err := getKlinesInterval(endpoint, query, markKlineInterval, start, end)
+	if err != nil {
+		log.Println("Skipping klines. Unexpected response | ", err)
+		return opens
+	}
+	for _, kline := range klines {
+		open, err := decimal.NewFromString(kline[1].(string))
+		if err != nil {
+			log.Fatal("error parsing decimal | ", err)
+		}
+		opens[int64(kline[0].(float64))] = open
+	}
+	return opens
+}
@@ -57,14 +57,15 @@ df.dropna(subset=['returns'], inplace=True)
 returns_df = df.groupby('funding_time')['returns'].mean().reset_index()
 
 # PostgreSQL query to fetch data from your table
+# Stats are precomputed per settlement by the Go ingester
 query = '''SELECT funding_time,
-            AVG(funding_rate) AS avg_funding_rate, 
-            MIN(funding_rate) AS min_funding_rate, 
-            PERCENTILE_CONT(0.25) WITHIN GROUP(ORDER BY funding_rate) AS q1_funding_rate, 
-            PERCENTILE_CONT(0.5) WITHIN GROUP(ORDER BY funding_rate) AS q2_funding_rate, 
-            PERCENTILE_CONT(0.75) WITHIN GROUP(ORDER BY funding_rate) AS q3_funding_rate, 
-            MAX(funding_rate) AS max_funding_rate 
-            FROM top100_historical_funding_rates GROUP BY funding_time;
+            mean_funding_rate AS avg_funding_rate, 
+            min_funding_rate, 
+            q1_funding_rate, 
+            median_funding_rate AS q2_funding_rate, 
+            q3_funding_rate, 
+            max_funding_rate 
+            FROM top100_funding_aggregates;
         '''
 # Execute the query
 cur.execute(query)
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLite column types of each columnKind. Timestamps and dates are ISO 8601
+// text, SQLite's convention for dates, and decimals are text so they keep
+// their exact digits. DuckDB reads the file with its sqlite extension, eg.
+// ATTACH 'top10.sqlite' (TYPE sqlite)
+var sqliteTypes = map[columnKind]string{
+	kindTimestamp: "TEXT",
+	kindDate:      "TEXT",
+	kindText:      "TEXT",
+	kindInteger:   "INTEGER",
+	kindDecimal:   "TEXT",
+	kindBoolean:   "INTEGER",
+}
+
+// publishCommand parses the publish command's flags and snapshots every
+// dataset in exportDatasets of a universe into a single SQLite file, with a
+// metadata table describing how it was built
+func publishCommand(ctx context.Context, dbpool *pgxpool.Pool, args []string) {
+	// #region Parse flags
+	flags := flag.NewFlagSet("publish", flag.ExitOnError)
+	universe := flags.String("universe", universeName, "universe to publish, eg. top10")
+	out := flags.String("out", "", "output file, defaults to <universe>.sqlite")
+	from := flags.String("from", "", "first date to publish, YYYY-MM-DD")
+	to := flags.String("to", "", "date to publish up to, excluded, YYYY-MM-DD")
+	flags.Parse(args)
+	filter := exportFilter{universe: *universe}
+	var err error
+	if *from != "" {
+		filter.from, err = time.Parse("2006-01-02", *from)
+		if err != nil {
+			log.Fatal("Invalid from date, expected YYYY-MM-DD | ", err)
+		}
+	}
+	if *to != "" {
+		filter.to, err = time.Parse("2006-01-02", *to)
+		if err != nil {
+			log.Fatal("Invalid to date, expected YYYY-MM-DD | ", err)
+		}
+	}
+	if *out == "" {
+		*out = filter.universe + ".sqlite"
+	} // #endregion
+
+	// #region Create a new SQLite file, replacing an earlier publish
+	err = os.Remove(*out)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal("Unable to remove earlier output file | ", err)
+	}
+	db, err := sql.Open("sqlite3", *out)
+	if err != nil {
+		log.Fatal("Unable to open sqlite file | ", err)
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal("Unable to begin sqlite transaction | ", err)
+	} // #endregion
+
+	// #region Copy every dataset to a table of the same name
+	metadata := [][2]string{}
+	var first, last string
+	for _, dataset := range exportDatasets {
+		var columns, definitions, placeholders []string
+		for _, column := range dataset.columns {
+			columns = append(columns, column.name)
+			definitions = append(definitions, column.name+" "+sqliteTypes[column.kind])
+			placeholders = append(placeholders, "?")
+		}
+		_, err = tx.Exec(`CREATE TABLE ` + dataset.name + ` (` + strings.Join(definitions, ", ") + `)`)
+		if err != nil {
+			log.Fatalf("Unable to create the '%s' sqlite table | %v", dataset.name, err)
+		}
+		insert, err := tx.Prepare(`INSERT INTO ` + dataset.name + ` (` + strings.Join(columns, ", ") + `) VALUES (` + strings.Join(placeholders, ", ") + `)`)
+		if err != nil {
+			log.Fatal("Unable to prepare sqlite insert | ", err)
+		}
+		row := make([]any, len(dataset.columns))
+		count := streamDataset(ctx, dbpool, dataset, filter, func(values []*string) error {
+			for i, value := range values {
+				switch {
+				case value == nil:
+					row[i] = nil
+				case dataset.columns[i].kind == kindTimestamp:
+					row[i] = formatTimestamp(*value)
+				case dataset.columns[i].kind == kindBoolean:
+					row[i] = *value == "true"
+				default:
+					row[i] = *value
+				}
+			}
+			// settlement times of the funding dataset bound the published range
+			if dataset.name == "funding" && values[0] != nil {
+				if first == "" {
+					first = formatTimestamp(*values[0])
+				}
+				last = formatTimestamp(*values[0])
+			}
+			_, err := insert.Exec(row...)
+			return err
+		})
+		insert.Close()
+		metadata = append(metadata, [2]string{dataset.name + "_rows", strconv.FormatInt(count, 10)})
+		log.Printf("Published %d rows of the %s dataset of universe %s", count, dataset.name, filter.universe)
+	} // #endregion
+
+	// #region Describe the dataset in the metadata table
+	// runs that stored the published memberships, settlements and marks. Rows
+	// from before runs were recorded have no run id
+	var rangeFrom, rangeTo any
+	if !filter.from.IsZero() {
+		rangeFrom = filter.from
+	}
+	if !filter.to.IsZero() {
+		rangeTo = filter.to
+	}
+	inRange := func(timeColumn string) string {
+		return `($2::TIMESTAMPTZ IS NULL OR ` + timeColumn + ` >= $2) AND ($3::TIMESTAMPTZ IS NULL OR ` + timeColumn + ` < $3)`
+	}
+	runRows, err := dbpool.Query(ctx, `
+		WITH members AS (
+			SELECT * FROM `+universeMembershipTableName+`
+			WHERE universe = $1
+			AND ($2::TIMESTAMPTZ IS NULL OR period_end::TIMESTAMP AT TIME ZONE 'UTC' > $2)
+			AND ($3::TIMESTAMPTZ IS NULL OR rebalance_date::TIMESTAMP AT TIME ZONE 'UTC' < $3)
+		)
+		SELECT run_id::TEXT FROM (
+			SELECT run_id FROM members
+			UNION
+			SELECT s.run_id FROM members m
+			JOIN `+fundingSettlementsTableName+` s ON s.binance_symbol = m.binance_symbol
+				AND s.settlement_time >= m.rebalance_date::TIMESTAMP AT TIME ZONE 'UTC'
+				AND s.settlement_time < m.period_end::TIMESTAMP AT TIME ZONE 'UTC'
+			WHERE `+inRange("s.settlement_time")+`
+			UNION
+			SELECT p.run_id FROM members m
+			JOIN `+markPricesTableName+` p ON p.binance_symbol = m.binance_symbol
+				AND p.mark_time >= m.rebalance_date::TIMESTAMP AT TIME ZONE 'UTC'
+				AND p.mark_time < m.period_end::TIMESTAMP AT TIME ZONE 'UTC'
+			WHERE `+inRange("p.mark_time")+`
+		) runs
+		WHERE runs.run_id IS NOT NULL
+		ORDER BY runs.run_id`, filter.universe, rangeFrom, rangeTo)
+	if err != nil {
+		log.Fatal("error querying rows | ", err)
+	}
+	runIds, err := pgx.CollectRows(runRows, pgx.RowTo[string])
+	if err != nil {
+		log.Fatal("error collecting rows | ", err)
+	}
+	// the configured size, or the most members of any period for other universes
+	topN := universeSelector.Size()
+	if filter.universe != universeName {
+		dbpool.QueryRow(ctx, `SELECT COALESCE(MAX(members), 0) FROM (SELECT COUNT(*) AS members FROM `+universeMembershipTableName+` WHERE universe = $1 GROUP BY rebalance_date) m`, filter.universe).Scan(&topN)
+	}
+	metadata = append(metadata,
+		[2]string{"source", "Binance USD-M futures public API, universe ranked by CoinMarketCap snapshots in " + snapshotsTableName},
+		[2]string{"universe", filter.universe},
+		[2]string{"top_n", strconv.Itoa(topN)},
+		[2]string{"first_settlement_time", first},
+		[2]string{"last_settlement_time", last},
+		[2]string{"filter_from", *from},
+		[2]string{"filter_to", *to},
+		[2]string{"ingestion_run_ids", strings.Join(runIds, ",")},
+		[2]string{"published_at", time.Now().UTC().Format(time.RFC3339)},
+	)
+	_, err = tx.Exec(`CREATE TABLE metadata (key TEXT PRIMARY KEY, value TEXT)`)
+	if err != nil {
+		log.Fatal("Unable to create the 'metadata' sqlite table | ", err)
+	}
+	for _, entry := range metadata {
+		_, err = tx.Exec(`INSERT INTO metadata (key, value) VALUES (?, ?)`, entry[0], entry[1])
+		if err != nil {
+			log.Fatal("Unable to insert sqlite metadata | ", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Fatal("Unable to commit sqlite transaction | ", err)
+	}
+	log.Printf("Published universe %s from %s to %s to %s", filter.universe, first, last, *out) // #endregion
+}
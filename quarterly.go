@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+	"github.com/shopspring/decimal"
+)
+
+// Table name in database that will be created by this program and filled with
+// the quarterly futures basis term structure at every funding settlement
+var quarterlyBasisTableName = universeName + "_quarterly_basis"
+
+// Continuous contract types polled from the continuousKlines API
+var quarterlyContractTypes = []string{"CURRENT_QUARTER", "NEXT_QUARTER"}
+
+// quarterlyDelivery returns the delivery time of the contractType quarterly
+// trading at t. Binance quarterlies deliver at 08:00 UTC on the last Friday of
+// March, June, September and December
+func quarterlyDelivery(t time.Time, contractType string) time.Time {
+	deliveries := 1
+	if contractType == "NEXT_QUARTER" {
+		deliveries = 2
+	}
+	year, month := t.Year(), time.Month((int(t.Month())-1)/3*3+3)
+	for {
+		// last day of the quarter month, stepped back to friday
+		delivery := time.Date(year, month+1, 1, 8, 0, 0, 0, time.UTC).AddDate(0, 0, -1)
+		for delivery.Weekday() != time.Friday {
+			delivery = delivery.AddDate(0, 0, -1)
+		}
+		if delivery.After(t) {
+			deliveries--
+			if deliveries == 0 {
+				return delivery
+			}
+		}
+		month += 3
+		if month > time.December {
+			month -= 12
+			year++
+		}
+	}
+}
+
+// ingestQuarterlyBasis creates quarterlyBasisTableName if it does not exist
+// and fills it with the current and next quarter futures prices, their basis
+// to the index price and the basis annualized over the time to delivery, for
+// every pair with listed quarterlies and every snapshot_date in
+// fundingTableName from the pair's last entry
+func ingestQuarterlyBasis(ctx context.Context, dbpool *pgxpool.Pool) {
+	// #region Create table "topN_quarterly_basis" if not exists
+	queryCreateTable := `CREATE TABLE IF NOT EXISTS ` + quarterlyBasisTableName + `(
+		basis_time TIMESTAMPTZ NOT NULL,
+		symbol TEXT,
+		contract_type TEXT,
+		delivery_time TIMESTAMPTZ NOT NULL,
+		futures_price DECIMAL NOT NULL,
+		index_price DECIMAL NOT NULL,
+		basis DECIMAL NOT NULL,
+		annualized_basis DECIMAL NOT NULL,
+		snapshot_date DATE,
+
+		PRIMARY KEY (symbol, contract_type, basis_time)
+		);
+		`
+	_, err := dbpool.Exec(ctx, queryCreateTable)
+	if err != nil {
+		log.Fatalf("Unable to create the '%s' table | %v", quarterlyBasisTableName, err)
+	} // #endregion
+
+	// #region Build list of pairs with quarterly contracts
+	pairs := append([]string{}, data.QuarterlyPairs...)
+	seen := make(map[string]bool)
+	for _, pair := range pairs {
+		seen[pair] = true
+	}
+	for _, contract := range getExchangeInfo().Symbols {
+		if contract.ContractType != "CURRENT_QUARTER" && contract.ContractType != "NEXT_QUARTER" {
+			continue
+		}
+		if contract.QuoteAsset != "USDT" || seen[contract.BaseAsset] {
+			continue
+		}
+		seen[contract.BaseAsset] = true
+		pairs = append(pairs, contract.BaseAsset)
+	} // #endregion
+
+	// Iterate over pairs and fill in basis for rebalance periods from the pair's last entry
+	for _, pair := range pairs {
+		// #region Make a periods slice for rebalance periods from the pair's last entry
+		var lastTime time.Time
+		queryLastTime := dbpool.QueryRow(ctx, `SELECT basis_time FROM `+quarterlyBasisTableName+` WHERE symbol = '`+pair+`' ORDER BY basis_time DESC LIMIT 1`)
+		queryLastTime.Scan(&lastTime)
+		// the last entry's period is refetched in case it was stored while in progress
+		periods := rebalancePeriods(ctx, dbpool, `f.settlement_time >= '`+lastTime.UTC().Format(time.RFC3339)+`'`) // #endregion
+
+		for _, period := range periods {
+			// #region Poll index price klines for the pair
+			indexResp, err := getKlines("https://fapi.binance.com/fapi/v1/indexPriceKlines", "pair="+pair+"USDT", period.Rebalance, period.End)
+			if err != nil {
+				log.Println("Skipping entry. No index klines for pair at rebalance date | ", err, period.Rebalance)
+				continue
+			}
+			indexes := make(map[int64]decimal.Decimal)
+			for _, indexKline := range indexResp {
+				index, err := decimal.NewFromString(indexKline[1].(string))
+				if err != nil {
+					log.Fatal("error parsing decimal | ", err)
+				}
+				indexes[int64(indexKline[0].(float64))] = index
+			} // #endregion
+
+			// #region Poll continuous klines for each contract type and compute basis
+			var queuedBasis []data.QuarterlyBasis
+			for _, contractType := range quarterlyContractTypes {
+				futuresResp, err := getKlines("https://fapi.binance.com/fapi/v1/continuousKlines", "pair="+pair+"USDT&contractType="+contractType, period.Rebalance, period.End)
+				if err != nil {
+					log.Println("Skipping entry. No continuous klines for pair at rebalance date | ", err, period.Rebalance)
+					continue
+				}
+				for _, futuresKline := range futuresResp {
+					openTime := int64(futuresKline[0].(float64))
+					index, ok := indexes[openTime]
+					if !ok || index.IsZero() {
+						continue
+					}
+					price, err := decimal.NewFromString(futuresKline[1].(string))
+					if err != nil {
+						log.Fatal("error parsing decimal | ", err)
+					}
+					basisTime := time.UnixMilli(openTime).UTC()
+					delivery := quarterlyDelivery(basisTime, contractType)
+					// division rounds to decimal.DivisionPrecision places
+					basis := price.Div(index).Sub(decimal.NewFromInt(1))
+					year := decimal.NewFromInt(int64(365 * 24 * time.Hour))
+					newBasis := data.QuarterlyBasis{
+						Symbol:          pair,
+						ContractType:    contractType,
+						Time:            openTime,
+						DeliveryTime:    delivery.UnixMilli(),
+						FuturesPrice:    price,
+						IndexPrice:      index,
+						Basis:           basis,
+						AnnualizedBasis: basis.Mul(year).Div(decimal.NewFromInt(int64(delivery.Sub(basisTime)))),
+					}
+					queuedBasis = append(queuedBasis, newBasis)
+				}
+				// from binance api: weight = 1 for limit [1,100]. 2400 weight/min = 40 queries/sec
+				time.Sleep(time.Millisecond * 25)
+			} // #endregion
+
+			// #region Batch insert queuedBasis to database
+			if len(queuedBasis) > 0 {
+				queryInsertData := `
+					INSERT INTO ` + quarterlyBasisTableName + `
+					(basis_time, symbol, contract_type, delivery_time, futures_price, index_price, basis, annualized_basis, snapshot_date)
+					VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+					ON CONFLICT (symbol, contract_type, basis_time) DO NOTHING;
+					`
+				batch := &pgx.Batch{}
+				for _, basis := range queuedBasis {
+					batch.Queue(queryInsertData, time.UnixMilli(basis.Time), basis.Symbol, basis.ContractType, time.UnixMilli(basis.DeliveryTime), basis.FuturesPrice, basis.IndexPrice, basis.Basis, basis.AnnualizedBasis, period.Snapshot)
+				}
+				br := dbpool.SendBatch(ctx, batch)
+				_, err = br.Exec()
+				if err != nil {
+					log.Fatal("Unable to execute statement in batch queue | ", err)
+				}
+				log.Printf("Successfully inserted %d rows to table %s for %s at rebalance_date %s", len(queuedBasis), quarterlyBasisTableName, pair, period.Rebalance)
+				err = br.Close()
+				if err != nil {
+					log.Fatal("Error closing batch | ", err)
+				}
+			} // #endregion
+		}
+	}
+	log.Println("Quarterly basis updates finished")
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+)
+
+// RebalanceSchedule decides the dates the universe is reselected on. Each
+// rebalance period runs from its rebalance date until the next one, ranked by
+// the most recent CoinMarketCap snapshot at or before the rebalance date
+type RebalanceSchedule interface {
+	// Suffix is appended to the universe name so universes rebalanced on
+	// different schedules are stored apart. Empty for the weekly schedule
+	Suffix() string
+	// First returns the first rebalance date at or after t
+	First(t time.Time) time.Time
+	// Next returns the rebalance date following rebalance, or the zero time
+	// if there is none
+	Next(rebalance time.Time) time.Time
+}
+
+// dailySchedule rebalances every day at 00:00 UTC
+type dailySchedule struct{}
+
+func (dailySchedule) First(t time.Time) time.Time {
+	day := t.UTC().Truncate(24 * time.Hour)
+	if day.Before(t) {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day
+}
+
+func (dailySchedule) Suffix() string                     { return "_daily" }
+func (dailySchedule) Next(rebalance time.Time) time.Time { return rebalance.AddDate(0, 0, 1) }
+
+// weeklySchedule rebalances every Sunday at 00:00 UTC, on CoinMarketCap's
+// weekly snapshots
+type weeklySchedule struct{}
+
+func (weeklySchedule) First(t time.Time) time.Time {
+	day := dailySchedule{}.First(t)
+	for day.Weekday() != time.Sunday {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day
+}
+
+func (weeklySchedule) Suffix() string                     { return "" }
+func (weeklySchedule) Next(rebalance time.Time) time.Time { return rebalance.AddDate(0, 0, 7) }
+
+// monthlySchedule rebalances on the first of every month at 00:00 UTC
+type monthlySchedule struct{}
+
+func (monthlySchedule) First(t time.Time) time.Time {
+	t = t.UTC()
+	month := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if month.Before(t) {
+		month = month.AddDate(0, 1, 0)
+	}
+	return month
+}
+
+func (monthlySchedule) Suffix() string                     { return "_monthly" }
+func (monthlySchedule) Next(rebalance time.Time) time.Time { return rebalance.AddDate(0, 1, 0) }
+
+// customSchedule rebalances on a hand picked list of dates in ascending
+// order. The last date only ends the period before it. name tells lists apart
+// in the universe name, "custom" when empty
+type customSchedule struct {
+	name  string
+	dates []time.Time
+}
+
+func (s customSchedule) Suffix() string {
+	if s.name == "" {
+		return "_custom"
+	}
+	return "_" + s.name
+}
+
+func (s customSchedule) First(t time.Time) time.Time {
+	for _, date := range s.dates {
+		if !date.Before(t) {
+			return date
+		}
+	}
+	return time.Time{}
+}
+
+func (s customSchedule) Next(rebalance time.Time) time.Time {
+	for _, date := range s.dates {
+		if date.After(rebalance) {
+			return date
+		}
+	}
+	return time.Time{}
+}
+
+// rebalancePeriods returns the rebalance periods with rows in fundingTableName
+// (aliased f) matching condition, ordered by rebalance date
+func rebalancePeriods(ctx context.Context, dbpool *pgxpool.Pool, condition string) []data.Period {
+	periodRows, err := dbpool.Query(ctx, `SELECT rebalance_date, MIN(snapshot_date) FROM `+fundingTableName+` f WHERE `+condition+` GROUP BY rebalance_date ORDER BY rebalance_date ASC`)
+	if err != nil {
+		log.Fatal("error querying rows | ", err)
+	}
+	periods, err := pgx.CollectRows(periodRows, func(row pgx.CollectableRow) (data.Period, error) {
+		var period data.Period
+		err := row.Scan(&period.Rebalance, &period.Snapshot)
+		period.End = rebalanceSchedule.Next(period.Rebalance)
+		if period.End.IsZero() {
+			period.End = time.Now().UTC()
+		}
+		return period, err
+	})
+	if err != nil {
+		log.Fatal("error collecting rows | ", err)
+	}
+	return periods
+}
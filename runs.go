@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Table in database shared by every universe recording each ingestion run, so
+// published datasets can name the runs they were built from
+var ingestionRunsTableName = "ingestion_runs"
+
+// startIngestionRun creates ingestionRunsTableName if it does not exist and
+// records the start of an ingestion run of the universe. Returns the run id
+func startIngestionRun(ctx context.Context, dbpool *pgxpool.Pool) int64 {
+	queryCreateTable := `CREATE TABLE IF NOT EXISTS ` + ingestionRunsTableName + `(
+		run_id BIGSERIAL PRIMARY KEY,
+		universe TEXT NOT NULL,
+		started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		finished_at TIMESTAMPTZ
+		);
+		`
+	_, err := dbpool.Exec(ctx, queryCreateTable)
+	if err != nil {
+		log.Fatalf("Unable to create the '%s' table | %v", ingestionRunsTableName, err)
+	}
+	var runId int64
+	err = dbpool.QueryRow(ctx, `INSERT INTO `+ingestionRunsTableName+` (universe) VALUES ($1) RETURNING run_id`, universeName).Scan(&runId)
+	if err != nil {
+		log.Fatal("Unable to record ingestion run | ", err)
+	}
+	log.Printf("Started ingestion run %d of universe %s", runId, universeName)
+	return runId
+}
+
+// finishIngestionRun records the end of the ingestion run runId. Runs that
+// exit with an error are left unfinished
+func finishIngestionRun(ctx context.Context, dbpool *pgxpool.Pool, runId int64) {
+	_, err := dbpool.Exec(ctx, `UPDATE `+ingestionRunsTableName+` SET finished_at = NOW() WHERE run_id = $1`, runId)
+	if err != nil {
+		log.Fatal("Unable to record ingestion run | ", err)
+	}
+	log.Printf("Finished ingestion run %d of universe %s", runId, universeName)
+}
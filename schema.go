@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+)
+
+// Tables in database shared by every universe. Funding and mark data are
+// stored once per binance contract and universes only record which contracts
+// were members of each rebalance period, so runs with different topN values
+// don't fetch the same settlements twice
+var (
+	// binance contracts with their CMC asset and contract multiplier
+	instrumentsTableName = "instruments"
+	// every funding settlement fetched, keyed by contract and funding time
+	fundingSettlementsTableName = "funding_settlements"
+	// mark, index and premium index klines at funding settlements
+	markPricesTableName = "mark_prices"
+	// contracts in each universe for each rebalance period
+	universeMembershipTableName = "universe_membership"
+)
+
+// createNormalizedTables creates the tables shared by every universe if they
+// do not exist. run_id is the ingestion run that stored the row, NULL for rows
+// migrated from the legacy table
+func createNormalizedTables(ctx context.Context, dbpool *pgxpool.Pool) {
+	queryCreateTables := `
+		CREATE TABLE IF NOT EXISTS ` + instrumentsTableName + `(
+			binance_symbol TEXT PRIMARY KEY,
+			symbol TEXT NOT NULL,
+			asset_id TEXT,
+			contract_multiplier DECIMAL NOT NULL DEFAULT 1
+			);
+		CREATE TABLE IF NOT EXISTS ` + fundingSettlementsTableName + `(
+			binance_symbol TEXT NOT NULL REFERENCES ` + instrumentsTableName + `(binance_symbol),
+			funding_time TIMESTAMPTZ NOT NULL,
+			settlement_time TIMESTAMPTZ NOT NULL,
+			funding_rate DECIMAL NOT NULL,
+			mark_price DECIMAL,
+			run_id BIGINT,
+
+			PRIMARY KEY (binance_symbol, settlement_time)
+			);
+		CREATE TABLE IF NOT EXISTS ` + markPricesTableName + `(
+			binance_symbol TEXT NOT NULL REFERENCES ` + instrumentsTableName + `(binance_symbol),
+			mark_time TIMESTAMPTZ NOT NULL,
+			mark_price DECIMAL,
+			index_price DECIMAL,
+			premium_index DECIMAL,
+			run_id BIGINT,
+
+			PRIMARY KEY (binance_symbol, mark_time)
+			);
+		CREATE TABLE IF NOT EXISTS ` + universeMembershipTableName + `(
+			universe TEXT NOT NULL,
+			rebalance_date DATE NOT NULL,
+			period_end DATE NOT NULL,
+			snapshot_date DATE NOT NULL,
+			asset_id TEXT,
+			symbol TEXT NOT NULL,
+			binance_symbol TEXT NOT NULL REFERENCES ` + instrumentsTableName + `(binance_symbol),
+			rank INTEGER NOT NULL,
+			provisional BOOLEAN NOT NULL DEFAULT FALSE,
+			run_id BIGINT,
+
+			PRIMARY KEY (universe, rebalance_date, binance_symbol),
+			FOREIGN KEY (snapshot_date, rank, symbol) REFERENCES ` + snapshotsTableName + `(snapshot_date, rank, symbol)
+			);
+		`
+	_, err := dbpool.Exec(ctx, queryCreateTables)
+	if err != nil {
+		log.Fatal("Unable to create the normalized tables | ", err)
+	}
+}
+
+// settlementTime returns the settlement a funding time in milliseconds belongs
+// to. Binance stamps some settlements a few milliseconds after the boundary.
+// Every funding interval binance uses is a whole number of hours aligned to UTC
+// and a symbol's interval can change over its history, so rounding to the hour
+// lands on the symbol's interval boundary without looking the interval up
+func settlementTime(fundingTime int64) time.Time {
+	return time.UnixMilli(fundingTime).UTC().Round(time.Hour)
+}
+
+// sqlSettlementTime returns the SQL expression rounding the TIMESTAMPTZ
+// expression to its settlement, as settlementTime does
+func sqlSettlementTime(expression string) string {
+	return "date_trunc('hour', " + expression + " + INTERVAL '30 minutes')"
+}
+
+// createFundingView creates fundingTableName as a view joining the universe's
+// memberships to the shared settlements and marks, in the shape of the table
+// it replaced so the python scripts and the other ingesters read it unchanged
+func createFundingView(ctx context.Context, dbpool *pgxpool.Pool) {
+	// funding_time is the settlement in milliseconds, see settlementTime, so rows
+	// of a settlement group and join exactly. funding_time_raw is binance's own timestamp
+	// mark_price is the markPrice binance sent with the funding rate when it
+	// did and the mark kline opening at the settlement otherwise
+	queryCreateView := `
+		CREATE OR REPLACE VIEW ` + fundingTableName + ` AS
+		SELECT (EXTRACT(EPOCH FROM s.settlement_time) * 1000)::BIGINT AS funding_time, m.symbol, s.funding_rate,
+			COALESCE(s.mark_price, p.mark_price) AS mark_price,
+			p.index_price, p.premium_index,
+			m.snapshot_date, m.rank, m.provisional, m.rebalance_date, m.asset_id, m.binance_symbol,
+			i.contract_multiplier,
+			COALESCE(s.mark_price, p.mark_price) / i.contract_multiplier AS mark_price_per_unit,
+			p.index_price / i.contract_multiplier AS index_price_per_unit,
+			s.settlement_time, s.funding_time AS funding_time_raw
+		FROM ` + universeMembershipTableName + ` m
+		JOIN ` + instrumentsTableName + ` i ON i.binance_symbol = m.binance_symbol
+		JOIN ` + fundingSettlementsTableName + ` s ON s.binance_symbol = m.binance_symbol
+			AND s.settlement_time >= m.rebalance_date::TIMESTAMP AT TIME ZONE 'UTC'
+			AND s.settlement_time < m.period_end::TIMESTAMP AT TIME ZONE 'UTC'
+		LEFT JOIN ` + markPricesTableName + ` p ON p.binance_symbol = s.binance_symbol AND p.mark_time = s.settlement_time
+		WHERE m.universe = '` + universeName + `';
+		`
+	_, err := dbpool.Exec(ctx, queryCreateView)
+	if err != nil {
+		log.Fatalf("Unable to create the '%s' view | %v", fundingTableName, err)
+	}
+}
+
+// migrateLegacyFundingTable moves the rows of fundingTableName into the shared
+// tables when it is still the table the original program created, and
+// renames it with a _legacy suffix so the view can take its name
+func migrateLegacyFundingTable(ctx context.Context, dbpool *pgxpool.Pool) {
+	// #region Check for a legacy table
+	var tableType string
+	dbpool.QueryRow(ctx, `SELECT table_type FROM information_schema.tables WHERE table_name = '`+fundingTableName+`'`).Scan(&tableType)
+	if tableType != "BASE TABLE" {
+		return
+	}
+	legacyTableName := fundingTableName + "_legacy"
+	log.Printf("Table %s predates the normalized schema. Migrating rows to the shared tables...", fundingTableName) // #endregion
+
+	// #region Map the legacy symbols to their contracts
+	// the legacy table stored CMC tickers, and prices per contract for 1000x contracts
+	symbolRows, err := dbpool.Query(ctx, `SELECT DISTINCT symbol FROM `+fundingTableName)
+	if err != nil {
+		log.Fatal("error querying rows | ", err)
+	}
+	symbols, err := pgx.CollectRows(symbolRows, pgx.RowTo[string])
+	if err != nil {
+		log.Fatal("error collecting rows | ", err)
+	}
+	var contracts, multipliers []string
+	for _, symbol := range symbols {
+		contract := binanceSymbol(symbol)
+		contracts = append(contracts, contract)
+		multipliers = append(multipliers, contractMultiplier(contract).String())
+	}
+	legacyRows := fundingTableName + ` l JOIN unnest($1::TEXT[], $2::TEXT[], $3::TEXT[]) AS c(symbol, binance_symbol, contract_multiplier) ON c.symbol = l.symbol` // #endregion
+
+	// #region Copy instruments and settlements, keeping rows other universes already stored
+	batch := &pgx.Batch{}
+	batch.Queue(`
+		INSERT INTO `+instrumentsTableName+` (binance_symbol, symbol, contract_multiplier)
+		SELECT c.binance_symbol, c.symbol, c.contract_multiplier::DECIMAL
+		FROM unnest($1::TEXT[], $2::TEXT[], $3::TEXT[]) AS c(symbol, binance_symbol, contract_multiplier)
+		ON CONFLICT (binance_symbol) DO NOTHING`, symbols, contracts, multipliers)
+	// mark_price is the markPrice sent with the funding rate or the mark
+	// kline the original backfill filled in
+	batch.Queue(`
+		INSERT INTO `+fundingSettlementsTableName+` (binance_symbol, funding_time, settlement_time, funding_rate, mark_price)
+		SELECT DISTINCT ON (c.binance_symbol, `+sqlSettlementTime("to_timestamp(l.funding_time / 1000.0)")+`) c.binance_symbol,
+			to_timestamp(l.funding_time / 1000.0), `+sqlSettlementTime("to_timestamp(l.funding_time / 1000.0)")+`, l.funding_rate, l.mark_price
+		FROM `+legacyRows+`
+		ON CONFLICT (binance_symbol, settlement_time) DO NOTHING`, symbols, contracts, multipliers) // #endregion
+
+	// #region Copy memberships. The original program rebalanced weekly on each snapshot
+	batch.Queue(`
+		INSERT INTO `+universeMembershipTableName+`
+		(universe, rebalance_date, period_end, snapshot_date, symbol, binance_symbol, rank)
+		SELECT DISTINCT ON (l.snapshot_date, c.binance_symbol) $4, l.snapshot_date, l.snapshot_date + 7, l.snapshot_date, l.symbol, c.binance_symbol, l.rank
+		FROM `+legacyRows+`
+		ON CONFLICT (universe, rebalance_date, binance_symbol) DO NOTHING`, symbols, contracts, multipliers, universeName) // #endregion
+
+	// #region Rename the legacy table out of the view's way
+	batch.Queue(`ALTER TABLE ` + fundingTableName + ` RENAME TO ` + legacyTableName)
+	br := dbpool.SendBatch(ctx, batch)
+	_, err = br.Exec()
+	if err != nil {
+		log.Fatal("Unable to execute statement in batch queue | ", err)
+	}
+	err = br.Close()
+	if err != nil {
+		log.Fatal("Error closing batch | ", err)
+	}
+	log.Printf("Migrated %d symbols from %s, kept as %s", len(symbols), fundingTableName, legacyTableName) // #endregion
+}
+
+// storedFundingRates returns the settlements of contract in period another
+// universe already fetched, or false when they don't cover the period and
+// binance has to be polled
+func storedFundingRates(ctx context.Context, dbpool *pgxpool.Pool, contract string, period data.Period) ([]data.FundingRateApiResp, bool) {
+	if periodInProgress(period) {
+		return nil, false
+	}
+	settlementRows, err := dbpool.Query(ctx, `
+		SELECT binance_symbol, (EXTRACT(EPOCH FROM funding_time) * 1000)::BIGINT, funding_rate::TEXT, COALESCE(mark_price::TEXT, '')
+		FROM `+fundingSettlementsTableName+`
+		WHERE binance_symbol = $1 AND settlement_time >= $2 AND settlement_time < $3
+		ORDER BY settlement_time ASC`, contract, period.Rebalance, period.End)
+	if err != nil {
+		log.Fatal("error querying rows | ", err)
+	}
+	fundingRates, err := pgx.CollectRows(settlementRows, pgx.RowToStructByPos[data.FundingRateApiResp])
+	if err != nil {
+		log.Fatal("error collecting rows | ", err)
+	}
+	if len(fundingRates) < periodSettlements(period, fundingInterval(fundingRates)) {
+		return nil, false
+	}
+	return fundingRates, true
+}
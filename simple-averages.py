@@ -56,10 +56,11 @@ returns_df = df.groupby('funding_time')['avg_returns'].mean().reset_index()
 returns_df = returns_df.sort_values('funding_time')
 
 # PostgreSQL query to fetch data from your table
+# Stats are precomputed per settlement by the Go ingester
 query = '''SELECT funding_time,
-            AVG(funding_rate) AS avg_funding_rate,
-            PERCENTILE_CONT(0.5) WITHIN GROUP(ORDER BY funding_rate) AS med_funding_rate
-            FROM top10_historical_funding_rates GROUP BY funding_time;
+            mean_funding_rate AS avg_funding_rate,
+            median_funding_rate AS med_funding_rate
+            FROM top10_funding_aggregates;
         '''
         
 # Execute the query
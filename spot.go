@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+	"github.com/shopspring/decimal"
+)
+
+// Table name in database that will be created by this program and filled with
+// spot prices at every funding settlement for the symbols in fundingTableName
+var spotTableName = universeName + "_spot_prices"
+
+// View joining fundingTableName with spotTableName and computing perp-spot
+// basis at every settlement
+var fundingSpotViewName = universeName + "_funding_with_spot"
+
+// spotSymbol converts a symbol as stored in the database to the Binance spot
+// USDT pair for the base asset. Unlike binanceSymbol, 1000x contracts trade
+// the plain base asset on spot
+func spotSymbol(symbol string) string {
+	// Handle edge case where IOTA on binance is MIOTA on CMC
+	if symbol == "MIOTA" {
+		symbol = "IOTA"
+	}
+	return symbol + "USDT"
+}
+
+// ingestSpotPrices creates spotTableName if it does not exist and fills it
+// with the spot open price at every funding settlement in fundingTableName
+// that doesn't already have spot data. Settlements without a spot kline, eg.
+// before the spot listing or for perps binance has no spot market for, are
+// stored without a price so they aren't polled again
+func ingestSpotPrices(ctx context.Context, dbpool *pgxpool.Pool) {
+	// #region Create table "topN_spot_prices" and basis view if not exists
+	queryCreateTable := `CREATE TABLE IF NOT EXISTS ` + spotTableName + `(
+		spot_time TIMESTAMPTZ NOT NULL,
+		symbol TEXT,
+		spot_price DECIMAL,
+		snapshot_date DATE,
+
+		PRIMARY KEY (symbol, spot_time)
+		);
+		`
+	_, err := dbpool.Exec(ctx, queryCreateTable)
+	if err != nil {
+		log.Fatalf("Unable to create the '%s' table | %v", spotTableName, err)
+	}
+	// Spot prices are per unit, so basis compares the per unit mark price.
+	// The view is recreated since f.* changes when columns are added
+	queryCreateView := `DROP VIEW IF EXISTS ` + fundingSpotViewName + `;
+		CREATE VIEW ` + fundingSpotViewName + ` AS
+		SELECT f.*, s.spot_price, f.mark_price_per_unit / s.spot_price - 1 AS basis
+		FROM ` + fundingTableName + ` f
+		LEFT JOIN ` + spotTableName + ` s
+		ON s.symbol = f.symbol AND s.spot_time = f.settlement_time;
+		`
+	_, err = dbpool.Exec(ctx, queryCreateView)
+	if err != nil {
+		log.Fatalf("Unable to create the '%s' view | %v", fundingSpotViewName, err)
+	} // #endregion
+
+	// Build list of rebalance periods with settlements missing spot data
+	missingSpot := `NOT EXISTS (SELECT 1 FROM ` + spotTableName + ` s WHERE s.symbol = f.symbol AND s.spot_time = f.settlement_time)`
+	periods := rebalancePeriods(ctx, dbpool, missingSpot)
+
+	// Iterate over periods and fill in spot prices for symbols without them
+	noSpotMarket := make(map[string]bool)
+	for _, period := range periods {
+		// #region Build list of symbols with settlements missing spot data at rebalance_date
+		symbolRows, err := dbpool.Query(ctx, `SELECT symbol FROM `+fundingTableName+` f WHERE rebalance_date = '`+period.Rebalance.Format("2006-01-02")+`' AND `+missingSpot+` GROUP BY symbol`)
+		if err != nil {
+			log.Fatal("error querying rows | ", err)
+		}
+		symbols, err := pgx.CollectRows(symbolRows, pgx.RowTo[string])
+		if err != nil {
+			log.Fatal("error collecting rows | ", err)
+		} // #endregion
+
+		// Iterate over list of symbols and poll binance spot klines API
+		var queuedSpots []data.SpotApiResp
+		for _, symbol := range symbols {
+			// #region Build list of the symbol's settlement times missing spot data
+			timeRows, err := dbpool.Query(ctx, `SELECT settlement_time FROM `+fundingTableName+` f WHERE symbol = $1 AND rebalance_date = $2 AND `+missingSpot+` ORDER BY settlement_time ASC`, symbol, period.Rebalance)
+			if err != nil {
+				log.Fatal("error querying rows | ", err)
+			}
+			settlementTimes, err := pgx.CollectRows(timeRows, pgx.RowTo[time.Time])
+			if err != nil {
+				log.Fatal("error collecting rows | ", err)
+			} // #endregion
+
+			// #region Poll hourly spot klines and key them by open time
+			opens := make(map[int64]decimal.Decimal)
+			if !noSpotMarket[symbol] {
+				start := settlementTimes[0]
+				end := settlementTimes[len(settlementTimes)-1].Add(time.Hour)
+				respInfc, err := getKlinesInterval("https://api.binance.com/api/v3/klines", "symbol="+spotSymbol(symbol), time.Hour, start, end)
+				if err != nil {
+					// not every perp has a spot market on binance, other errors are retried next run
+					if !strings.Contains(err.Error(), `"code":-1121`) {
+						log.Println("Skipping entry. Unexpected response for spot klines at rebalance date | ", err, period.Rebalance)
+						continue
+					}
+					log.Println("No spot market for symbol, storing its settlements without spot prices | ", symbol)
+					noSpotMarket[symbol] = true
+				}
+				for _, spotResp := range respInfc {
+					price, err := decimal.NewFromString(spotResp[1].(string))
+					if err != nil {
+						log.Fatal("error parsing decimal | ", err)
+					}
+					opens[int64(spotResp[0].(float64))] = price
+				}
+				// from binance api: weight = 2 for spot klines. 6000 weight/min
+				time.Sleep(time.Millisecond * 50)
+			} // #endregion
+
+			// #region Align each settlement to the kline opening at its settlement time
+			for _, settlementTime := range settlementTimes {
+				newSpot := data.SpotApiResp{Symbol: symbol, Time: settlementTime.UnixMilli()}
+				if price, ok := opens[settlementTime.UnixMilli()]; ok {
+					newSpot.Price = decimal.NewNullDecimal(price)
+				}
+				queuedSpots = append(queuedSpots, newSpot)
+			} // #endregion
+		}
+
+		// #region Batch insert queuedSpots to database
+		if len(queuedSpots) > 0 {
+			queryInsertData := `
+				INSERT INTO ` + spotTableName + `
+				(spot_time, symbol, spot_price, snapshot_date)
+				VALUES ($1, $2, $3, $4)
+				ON CONFLICT (symbol, spot_time) DO NOTHING;
+				`
+			batch := &pgx.Batch{}
+			for _, spot := range queuedSpots {
+				batch.Queue(queryInsertData, time.UnixMilli(spot.Time), spot.Symbol, spot.Price, period.Snapshot)
+			}
+			br := dbpool.SendBatch(ctx, batch)
+			_, err = br.Exec()
+			if err != nil {
+				log.Fatal("Unable to execute statement in batch queue | ", err)
+			}
+			log.Printf("Successfully inserted %d rows to table %s at rebalance_date %s", len(queuedSpots), spotTableName, period.Rebalance)
+			err = br.Close()
+			if err != nil {
+				log.Fatal("Error closing batch | ", err)
+			}
+		} // #endregion
+	}
+	log.Println("Spot price updates finished")
+}
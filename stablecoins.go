@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+)
+
+// Number of daily closes the price-stability heuristic looks back over
+const stablePriceDays = 30
+
+// stablecoinClassifier decides which candidates are stablecoins and are kept
+// out of every universe. Tickers in data.StableCoins or extraStableCoins are
+// always stablecoins. Other symbols are classified by price, when their daily
+// closes over the stablePriceDays before a rebalance stay within
+// stablePriceBand of their median
+type stablecoinClassifier struct {
+	listed map[string]bool
+	band   float64
+}
+
+// newStablecoinClassifier returns the stablecoinClassifier configured in main.go
+func newStablecoinClassifier() stablecoinClassifier {
+	classifier := stablecoinClassifier{listed: make(map[string]bool), band: stablePriceBand}
+	for _, symbol := range data.StableCoins {
+		classifier.listed[symbol] = true
+	}
+	for _, symbol := range extraStableCoins {
+		classifier.listed[symbol] = true
+	}
+	return classifier
+}
+
+// isListed returns true when symbol is a known stablecoin
+func (c stablecoinClassifier) isListed(symbol string) bool {
+	return c.listed[symbol]
+}
+
+// priceStable returns true with the audit detail when candidate's price stayed
+// pegged over the stablePriceDays before rebalance. Mark price klines are used
+// when binance lists a perp, spot klines otherwise
+func (c stablecoinClassifier) priceStable(candidate data.Symbol, rebalance time.Time) (string, bool) {
+	if c.band <= 0 {
+		return "", false
+	}
+	url := fmt.Sprintf("https://fapi.binance.com/fapi/v1/markPriceKlines?symbol=%s&interval=1d&limit=%d&endTime=%v", candidate.Contract, stablePriceDays, rebalance.UnixMilli()-1)
+	var respInfc [][]interface{}
+	source := "mark"
+	if !getJson(url, &respInfc) || len(respInfc) == 0 {
+		url = fmt.Sprintf("https://api.binance.com/api/v3/klines?symbol=%s&interval=1d&limit=%d&endTime=%v", spotSymbol(candidate.Symbol), stablePriceDays, rebalance.UnixMilli()-1)
+		source = "spot"
+		if !getJson(url, &respInfc) || len(respInfc) == 0 {
+			return "", false
+		}
+	}
+	// from binance api: weight = 1 for limit [1,100). 2400 weight/min = 40 queries/sec
+	time.Sleep(time.Millisecond * 25)
+	// a few days of history can't tell a peg from a quiet listing
+	if len(respInfc) < stablePriceDays/2 {
+		return "", false
+	}
+	var closes []float64
+	for _, kline := range respInfc {
+		price, err := strconv.ParseFloat(kline[4].(string), 64)
+		if err != nil {
+			return "", false
+		}
+		closes = append(closes, price)
+	}
+	sorted := append([]float64{}, closes...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+	if median == 0 {
+		return "", false
+	}
+	var deviation float64
+	for _, price := range closes {
+		deviation = math.Max(deviation, math.Abs(price/median-1))
+	}
+	if deviation > c.band {
+		return "", false
+	}
+	return fmt.Sprintf("%s closes within %.2f%% of %g over %d days", source, deviation*100, median, len(closes)), true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+)
+
+// Address the local websocket stand-in listens on. Point the stream command at
+// it with STREAM_URL=ws://localhost:8090 in db.env
+const standInAddr = "localhost:8090"
+
+// The stand-in drops every connection after this long so the stream
+// command's reconnect and backoff can be exercised locally
+const standInDropAfter = 45 * time.Second
+
+// Markets sent by the stand-in for the !markPrice@arr stream
+var standInSymbols = []string{"BTCUSDT", "ETHUSDT", "1000PEPEUSDT"}
+
+// serveMarkPriceStandIn runs a local stand-in for the binance futures combined
+// stream endpoint on addr, see markPriceStandIn
+func serveMarkPriceStandIn(addr string) {
+	http.Handle("/stream", markPriceStandIn(time.Second, standInDropAfter))
+	log.Printf("Mark price stand-in listening on ws://%s/stream", addr)
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
+
+// markPriceStandIn returns a handler standing in for the binance futures
+// combined stream endpoint. It sends a random walk of mark price updates every
+// tick for the requested <symbol>@markPrice streams or !markPrice@arr and drops
+// each connection after dropAfter
+func markPriceStandIn(tick time.Duration, dropAfter time.Duration) http.HandlerFunc {
+	upgrader := websocket.Upgrader{}
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Println("Upgrade error | ", err)
+			return
+		}
+		defer conn.Close()
+		log.Println("Stand-in client connected | ", r.URL.RawQuery)
+
+		// #region Parse requested streams into the symbols each one sends
+		streamSymbols := make(map[string][]string)
+		marks := make(map[string]float64)
+		streams := strings.Split(r.URL.Query().Get("streams"), "/")
+		for _, stream := range streams {
+			if strings.HasPrefix(stream, "!markPrice@arr") {
+				streamSymbols[stream] = standInSymbols
+			} else {
+				symbol, _, _ := strings.Cut(stream, "@")
+				streamSymbols[stream] = []string{strings.ToUpper(symbol)}
+			}
+			for _, symbol := range streamSymbols[stream] {
+				marks[symbol] = 100
+			}
+		} // #endregion
+
+		// #region Send an update for every stream each tick until dropped
+		dropAt := time.Now().Add(dropAfter)
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			if now.After(dropAt) {
+				log.Println("Stand-in dropping connection")
+				return
+			}
+			updates := make(map[string]data.MarkPriceEvent)
+			for symbol := range marks {
+				marks[symbol] *= 1 + (rand.Float64()-0.5)/100
+				updates[symbol] = data.MarkPriceEvent{
+					EventType:       "markPriceUpdate",
+					Time:            now.UnixMilli(),
+					Symbol:          symbol,
+					Mark:            strconv.FormatFloat(marks[symbol], 'f', 8, 64),
+					Index:           strconv.FormatFloat(marks[symbol]*0.9999, 'f', 8, 64),
+					EstimatedSettle: strconv.FormatFloat(marks[symbol]*0.9999, 'f', 8, 64),
+					FundingRate:     strconv.FormatFloat((rand.Float64()-0.3)/1000, 'f', 8, 64),
+					NextFundingTime: now.Truncate(8 * time.Hour).Add(8 * time.Hour).UnixMilli(),
+				}
+			}
+			for _, stream := range streams {
+				var payload interface{}
+				if strings.HasPrefix(stream, "!markPrice@arr") {
+					var arr []data.MarkPriceEvent
+					for _, symbol := range streamSymbols[stream] {
+						arr = append(arr, updates[symbol])
+					}
+					payload = arr
+				} else {
+					payload = updates[streamSymbols[stream][0]]
+				}
+				msg, err := json.Marshal(map[string]interface{}{"stream": stream, "data": payload})
+				if err != nil {
+					log.Fatal("json.Marshal error | ", err)
+				}
+				err = conn.WriteMessage(websocket.TextMessage, msg)
+				if err != nil {
+					log.Println("Stand-in client disconnected | ", err)
+					return
+				}
+			}
+		} // #endregion
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+)
+
+// Table name in database that will be created by this program and filled with
+// live mark price stream updates, including the predicted next funding rate
+var markPriceStreamTableName = universeName + "_mark_price_stream"
+
+// When true, subscribe to !markPrice@arr for every listed perp instead of one
+// <symbol>@markPrice stream per symbol in the latest snapshot of fundingTableName
+const streamAllMarkets = false
+
+// Base url of the binance futures websocket api. Overridden by STREAM_URL in
+// db.env, eg. to point at the local stand-in started with `go run . standin`
+const defaultStreamUrl = "wss://fstream.binance.com"
+
+// How often buffered stream updates are batch inserted to the database
+const streamFlushInterval = 10 * time.Second
+
+// Reconnect backoff doubles after every connection that fails before an update
+// is read, up to streamMaxBackoff, and resets once a connection reads one
+const streamMinBackoff = time.Second
+const streamMaxBackoff = time.Minute
+
+// Binance sends an update every second, so a silent connection is dead
+const streamReadTimeout = 30 * time.Second
+
+// streamMarkPrices creates markPriceStreamTableName if it does not exist,
+// subscribes to the binance mark price websocket streams and records every
+// update until the program is killed, reconnecting with exponential backoff
+// whenever the connection drops
+func streamMarkPrices(ctx context.Context, dbpool *pgxpool.Pool) {
+	// #region Create table "topN_mark_price_stream" if not exists
+	queryCreateTable := `CREATE TABLE IF NOT EXISTS ` + markPriceStreamTableName + `(
+		event_time TIMESTAMPTZ NOT NULL,
+		symbol TEXT,
+		mark_price DECIMAL NOT NULL,
+		index_price DECIMAL,
+		estimated_settle_price DECIMAL,
+		predicted_funding_rate DECIMAL,
+		next_funding_time TIMESTAMPTZ,
+		contract_multiplier DECIMAL NOT NULL DEFAULT 1,
+		mark_price_per_unit DECIMAL GENERATED ALWAYS AS (mark_price / contract_multiplier) STORED,
+		index_price_per_unit DECIMAL GENERATED ALWAYS AS (index_price / contract_multiplier) STORED,
+
+		PRIMARY KEY (symbol, event_time)
+		);
+		`
+	_, err := dbpool.Exec(ctx, queryCreateTable)
+	if err != nil {
+		log.Fatalf("Unable to create the '%s' table | %v", markPriceStreamTableName, err)
+	} // #endregion
+
+	// #region Build stream url for all markets or the latest snapshot's symbols
+	streamUrl := os.Getenv("STREAM_URL")
+	if streamUrl == "" {
+		streamUrl = defaultStreamUrl
+	}
+	var streams []string
+	if streamAllMarkets {
+		streams = []string{"!markPrice@arr@1s"}
+	} else {
+		symbols := fundingContracts(ctx, dbpool, `rebalance_date = (SELECT MAX(rebalance_date) FROM `+fundingTableName+`)`)
+		if len(symbols) == 0 {
+			log.Fatalf("No symbols in %s to stream. Run ingestion first or set streamAllMarkets", fundingTableName)
+		}
+		for _, symbol := range symbols {
+			streams = append(streams, strings.ToLower(symbol.Contract)+"@markPrice@1s")
+		}
+	}
+	streamUrl += "/stream?streams=" + strings.Join(streams, "/") // #endregion
+
+	// #region Read stream and reconnect with backoff when it drops
+	events := make(chan data.MarkPriceEvent, 1024)
+	go flushMarkPrices(ctx, dbpool, events)
+	readMarkPricesWithReconnect(ctx, streamUrl, events) // #endregion
+}
+
+// readMarkPricesWithReconnect reads the combined stream at streamUrl into
+// events until ctx is done, reconnecting with exponential backoff whenever the
+// connection drops
+func readMarkPricesWithReconnect(ctx context.Context, streamUrl string, events chan<- data.MarkPriceEvent) {
+	backoff := streamMinBackoff
+	for ctx.Err() == nil {
+		updates, err := readMarkPriceStream(ctx, streamUrl, events)
+		log.Println("Mark price stream disconnected | ", err)
+		// the stand-in and binance drop healthy connections too
+		if updates > 0 {
+			backoff = streamMinBackoff
+		}
+		log.Printf("Reconnecting in %v", backoff)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, streamMaxBackoff)
+	}
+}
+
+// readMarkPriceStream connects to the combined stream at streamUrl and sends
+// every mark price update to events until the connection fails or ctx is
+// done. Returns the number of updates read
+func readMarkPriceStream(ctx context.Context, streamUrl string, events chan<- data.MarkPriceEvent) (int, error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, streamUrl, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	log.Println("Mark price stream connected | ", streamUrl)
+	read := 0
+	for {
+		conn.SetReadDeadline(time.Now().Add(streamReadTimeout))
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return read, err
+		}
+		var combined data.CombinedStreamMsg
+		err = json.Unmarshal(msg, &combined)
+		if err != nil {
+			log.Println("Skipping message. json.Unmarshal error | ", err)
+			continue
+		}
+		// !markPrice@arr sends every market in one array, <symbol>@markPrice a single update
+		var updates []data.MarkPriceEvent
+		if strings.HasPrefix(strings.TrimSpace(string(combined.Data)), "[") {
+			err = json.Unmarshal(combined.Data, &updates)
+		} else {
+			var update data.MarkPriceEvent
+			err = json.Unmarshal(combined.Data, &update)
+			updates = append(updates, update)
+		}
+		if err != nil {
+			log.Println("Skipping message. json.Unmarshal error | ", err)
+			continue
+		}
+		for _, update := range updates {
+			// only USDT perps map back to database symbols
+			if !strings.HasSuffix(update.Symbol, "USDT") {
+				continue
+			}
+			events <- update
+			read++
+		}
+	}
+}
+
+// flushMarkPrices buffers updates from events and batch inserts them to
+// markPriceStreamTableName every streamFlushInterval
+func flushMarkPrices(ctx context.Context, dbpool *pgxpool.Pool, events <-chan data.MarkPriceEvent) {
+	queryInsertData := `
+		INSERT INTO ` + markPriceStreamTableName + `
+		(event_time, symbol, mark_price, index_price, estimated_settle_price, predicted_funding_rate, next_funding_time, contract_multiplier)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, ''), $7, $8)
+		ON CONFLICT (symbol, event_time) DO NOTHING;
+		`
+	ticker := time.NewTicker(streamFlushInterval)
+	defer ticker.Stop()
+	var queuedEvents []data.MarkPriceEvent
+	for {
+		select {
+		case event := <-events:
+			queuedEvents = append(queuedEvents, event)
+		case <-ticker.C:
+			if len(queuedEvents) == 0 {
+				continue
+			}
+			batch := &pgx.Batch{}
+			for _, event := range queuedEvents {
+				batch.Queue(queryInsertData, time.UnixMilli(event.Time), dbSymbol(event.Symbol), event.Mark, event.Index, event.EstimatedSettle, event.FundingRate, time.UnixMilli(event.NextFundingTime), contractMultiplier(event.Symbol))
+			}
+			br := dbpool.SendBatch(ctx, batch)
+			_, err := br.Exec()
+			if err != nil {
+				log.Fatal("Unable to execute statement in batch queue | ", err)
+			}
+			err = br.Close()
+			if err != nil {
+				log.Fatal("Error closing batch | ", err)
+			}
+			log.Printf("Successfully inserted %d rows to table %s", len(queuedEvents), markPriceStreamTableName)
+			queuedEvents = queuedEvents[:0]
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+)
+
+// standInUrl returns the combined stream url of the stand-in served by server
+func standInUrl(server *httptest.Server, streams ...string) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/stream?streams=" + strings.Join(streams, "/")
+}
+
+// receiveEvents returns the next n events, failing the test if they don't
+// arrive in time
+func receiveEvents(t *testing.T, events <-chan data.MarkPriceEvent, n int) []data.MarkPriceEvent {
+	t.Helper()
+	var received []data.MarkPriceEvent
+	timeout := time.After(10 * time.Second)
+	for len(received) < n {
+		select {
+		case event := <-events:
+			received = append(received, event)
+		case <-timeout:
+			t.Fatalf("received %d of %d events before timing out", len(received), n)
+		}
+	}
+	return received
+}
+
+func TestReadMarkPriceStream(t *testing.T) {
+	server := httptest.NewServer(markPriceStandIn(10*time.Millisecond, time.Hour))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		streams []string
+		// symbols of the updates sent each tick
+		symbols []string
+	}{
+		{"single stream", []string{"btcusdt@markPrice@1s"}, []string{"BTCUSDT"}},
+		{"combined streams", []string{"btcusdt@markPrice@1s", "1000pepeusdt@markPrice@1s"}, []string{"BTCUSDT", "1000PEPEUSDT"}},
+		{"all markets array", []string{"!markPrice@arr@1s"}, standInSymbols},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			events := make(chan data.MarkPriceEvent, 1024)
+			done := make(chan error, 1)
+			go func() {
+				_, err := readMarkPriceStream(ctx, standInUrl(server, tt.streams...), events)
+				done <- err
+			}()
+
+			received := receiveEvents(t, events, 2*len(tt.symbols))
+			symbols := make(map[string]int)
+			for _, event := range received {
+				if event.EventType != "markPriceUpdate" || event.Mark == "" || event.FundingRate == "" || event.Time == 0 {
+					t.Errorf("incomplete update %+v", event)
+				}
+				symbols[event.Symbol]++
+			}
+			for _, symbol := range tt.symbols {
+				if symbols[symbol] == 0 {
+					t.Errorf("no update for %s in %v", symbol, symbols)
+				}
+			}
+			if len(symbols) != len(tt.symbols) {
+				t.Errorf("updates for %v, want %v", symbols, tt.symbols)
+			}
+
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("readMarkPriceStream didn't return after ctx was cancelled")
+			}
+		})
+	}
+}
+
+func TestReadMarkPriceStreamReturnsOnDrop(t *testing.T) {
+	server := httptest.NewServer(markPriceStandIn(10*time.Millisecond, 100*time.Millisecond))
+	defer server.Close()
+
+	events := make(chan data.MarkPriceEvent, 1024)
+	read, err := readMarkPriceStream(context.Background(), standInUrl(server, "btcusdt@markPrice@1s"), events)
+	if err == nil {
+		t.Fatal("expected an error when the stand-in drops the connection")
+	}
+	if read == 0 || read != len(events) {
+		t.Errorf("read %d updates, %d sent to events", read, len(events))
+	}
+}
+
+func TestReadMarkPricesWithReconnect(t *testing.T) {
+	var connections atomic.Int32
+	standIn := markPriceStandIn(10*time.Millisecond, 100*time.Millisecond)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connections.Add(1)
+		standIn(w, r)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan data.MarkPriceEvent, 1024)
+	done := make(chan struct{})
+	go func() {
+		readMarkPricesWithReconnect(ctx, standInUrl(server, "btcusdt@markPrice@1s"), events)
+		close(done)
+	}()
+
+	// every connection reads updates, so the backoff stays at streamMinBackoff
+	// and the third connection is made before a doubled backoff could allow
+	deadline := time.After(3*streamMinBackoff - streamMinBackoff/4)
+	for connections.Load() < 3 {
+		select {
+		case <-events:
+		case <-deadline:
+			t.Fatalf("%d connections before timing out", connections.Load())
+		case <-done:
+			t.Fatal("readMarkPricesWithReconnect returned before ctx was cancelled")
+		}
+	}
+	receiveEvents(t, events, 1)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("readMarkPricesWithReconnect didn't return after ctx was cancelled")
+	}
+}
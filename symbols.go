@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+	"github.com/shopspring/decimal"
+)
+
+// binanceSymbol converts a symbol as stored in the database (CoinMarketCap
+// ticker) to the Binance USDT perpetual contract symbol
+func binanceSymbol(symbol string) string {
+	// Handle edge case where IOTA on binance is MIOTA on CMC
+	if symbol == "MIOTA" {
+		symbol = "IOTA"
+	}
+	for _, thousandSymbol := range data.ThousandSymbols {
+		if symbol == thousandSymbol {
+			symbol = "1000" + symbol
+		}
+	}
+	return symbol + "USDT"
+}
+
+// Prefixes binance puts on contracts quoting a multiple of the base asset, eg.
+// 1000PEPEUSDT quotes 1000 PEPE. Longest prefix first
+var contractPrefixes = []struct {
+	prefix     string
+	multiplier int64
+}{
+	{"1000000", 1000000},
+	{"1000", 1000},
+	{"1M", 1000000},
+}
+
+// splitContract returns the base asset of a Binance USDT perpetual contract
+// and the units of it one contract quotes
+func splitContract(contract string) (string, int64) {
+	base, _, _ := strings.Cut(contract, "USDT")
+	for _, contractPrefix := range contractPrefixes {
+		if strings.HasPrefix(base, contractPrefix.prefix) && len(base) > len(contractPrefix.prefix) {
+			return strings.TrimPrefix(base, contractPrefix.prefix), contractPrefix.multiplier
+		}
+	}
+	return base, 1
+}
+
+// contractMultiplier returns the units of the base asset a Binance USDT
+// perpetual contract quotes. Contract prices divided by it are per unit prices
+func contractMultiplier(contract string) decimal.Decimal {
+	_, multiplier := splitContract(contract)
+	return decimal.NewFromInt(multiplier)
+}
+
+// dbSymbol converts a Binance USDT perpetual contract symbol back to the
+// symbol stored in the database
+func dbSymbol(contract string) string {
+	symbol, _ := splitContract(contract)
+	if symbol == "IOTA" {
+		symbol = "MIOTA"
+	}
+	return symbol
+}
+
+// getExchangeInfo polls the binance futures exchangeInfo API for the contracts
+// currently listed or recently delisted
+func getExchangeInfo() data.ExchangeInfoApiResp {
+	res, err := http.Get("https://fapi.binance.com/fapi/v1/exchangeInfo")
+	if err != nil {
+		log.Fatal("http.Get error | ", err)
+	}
+	defer res.Body.Close()
+	msg, err := io.ReadAll(res.Body)
+	if err != nil {
+		log.Fatal("io.ReadAll error | ", err)
+	}
+	var exchangeInfo data.ExchangeInfoApiResp
+	err = json.Unmarshal(msg, &exchangeInfo)
+	if err != nil {
+		log.Fatal("json.Unmarshal error | ", err)
+	}
+	return exchangeInfo
+}
+
+// fundingContracts returns the symbols with rows in fundingTableName (aliased
+// f) matching condition, with the Binance contract stored at ingestion. Rows
+// from before contracts were stored fall back to binanceSymbol
+func fundingContracts(ctx context.Context, dbpool *pgxpool.Pool, condition string) []data.SymbolContract {
+	symbolRows, err := dbpool.Query(ctx, `SELECT symbol, COALESCE(MAX(binance_symbol), '') FROM `+fundingTableName+` f WHERE `+condition+` GROUP BY symbol`)
+	if err != nil {
+		log.Fatal("error querying rows | ", err)
+	}
+	symbols, err := pgx.CollectRows(symbolRows, pgx.RowToStructByPos[data.SymbolContract])
+	if err != nil {
+		log.Fatal("error collecting rows | ", err)
+	}
+	for i := range symbols {
+		if symbols[i].Contract == "" {
+			symbols[i].Contract = binanceSymbol(symbols[i].Symbol)
+		}
+	}
+	return symbols
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+)
+
+// Hypertable in database shared by every universe and filled with the funding
+// rate of each universe member at each settlement when useTimescale is set.
+// Continuous aggregates read a single hypertable, so the memberships the
+// funding view joins on a date range are flattened here
+var universeSettlementsTableName = "universe_settlements"
+
+// Continuous aggregate in database with the cross-sectional funding stats of
+// the universe at each settlement when useTimescale is set
+var settlementStatsViewName = universeName + "_settlement_stats"
+
+// setupTimescale creates the timescaledb extension, converts the shared
+// settlement and mark tables to hypertables and creates the universe's
+// continuous aggregate if they do not exist. Settlements the universe stored
+// before are flattened into universeSettlementsTableName
+func setupTimescale(ctx context.Context, dbpool *pgxpool.Pool) {
+	// #region Create the extension and hypertables, migrating rows already stored
+	queryCreateHypertables := `
+		CREATE EXTENSION IF NOT EXISTS timescaledb;
+		CREATE TABLE IF NOT EXISTS ` + universeSettlementsTableName + `(
+			universe TEXT NOT NULL,
+			settlement_time TIMESTAMPTZ NOT NULL,
+			binance_symbol TEXT NOT NULL,
+			funding_rate DECIMAL NOT NULL,
+
+			PRIMARY KEY (universe, binance_symbol, settlement_time)
+			);
+		SELECT create_hypertable('` + fundingSettlementsTableName + `', 'settlement_time', if_not_exists => TRUE, migrate_data => TRUE);
+		SELECT create_hypertable('` + markPricesTableName + `', 'mark_time', if_not_exists => TRUE, migrate_data => TRUE);
+		SELECT create_hypertable('` + universeSettlementsTableName + `', 'settlement_time', if_not_exists => TRUE, migrate_data => TRUE);
+		`
+	_, err := dbpool.Exec(ctx, queryCreateHypertables)
+	if err != nil {
+		log.Fatal("Unable to create the timescaledb hypertables | ", err)
+	} // #endregion
+
+	// #region Create the continuous aggregate, one bucket per settlement
+	// hourly buckets hold exactly one settlement, see settlementTime
+	queryCreateAggregate := `
+		CREATE MATERIALIZED VIEW IF NOT EXISTS ` + settlementStatsViewName + `
+		WITH (timescaledb.continuous) AS
+		SELECT time_bucket(INTERVAL '1 hour', settlement_time) AS settlement_time,
+			COUNT(*) AS symbols,
+			AVG(funding_rate) AS avg_funding_rate,
+			MIN(funding_rate) AS min_funding_rate,
+			PERCENTILE_CONT(0.25) WITHIN GROUP (ORDER BY funding_rate) AS q1_funding_rate,
+			PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY funding_rate) AS q2_funding_rate,
+			PERCENTILE_CONT(0.75) WITHIN GROUP (ORDER BY funding_rate) AS q3_funding_rate,
+			MAX(funding_rate) AS max_funding_rate
+		FROM ` + universeSettlementsTableName + `
+		WHERE universe = '` + universeName + `'
+		GROUP BY 1
+		WITH NO DATA;
+		`
+	_, err = dbpool.Exec(ctx, queryCreateAggregate)
+	if err != nil {
+		log.Fatalf("Unable to create the '%s' continuous aggregate | %v", settlementStatsViewName, err)
+	} // #endregion
+
+	// #region Flatten settlements stored before and refresh the whole aggregate
+	tag, err := dbpool.Exec(ctx, `
+		INSERT INTO `+universeSettlementsTableName+` (universe, settlement_time, binance_symbol, funding_rate)
+		SELECT $1, settlement_time, binance_symbol, funding_rate FROM `+fundingTableName+`
+		ON CONFLICT (universe, binance_symbol, settlement_time) DO NOTHING`, universeName)
+	if err != nil {
+		log.Fatalf("Unable to fill the '%s' table | %v", universeSettlementsTableName, err)
+	}
+	if tag.RowsAffected() > 0 {
+		log.Printf("Flattened %d settlements of universe %s to table %s", tag.RowsAffected(), universeName, universeSettlementsTableName)
+		refreshSettlementStats(ctx, dbpool, time.Time{}, time.Time{})
+	} // #endregion
+}
+
+// syncUniverseSettlements replaces the universe's settlements in period in
+// universeSettlementsTableName with its members' settlements in the funding
+// view and refreshes the continuous aggregate over the period
+func syncUniverseSettlements(ctx context.Context, dbpool *pgxpool.Pool, period data.Period) {
+	_, err := dbpool.Exec(ctx, `
+		DELETE FROM `+universeSettlementsTableName+` WHERE universe = $1 AND settlement_time >= $2 AND settlement_time < $3`, universeName, period.Rebalance, period.End)
+	if err != nil {
+		log.Fatalf("Unable to delete from the '%s' table | %v", universeSettlementsTableName, err)
+	}
+	_, err = dbpool.Exec(ctx, `
+		INSERT INTO `+universeSettlementsTableName+` (universe, settlement_time, binance_symbol, funding_rate)
+		SELECT $1, settlement_time, binance_symbol, funding_rate FROM `+fundingTableName+`
+		WHERE rebalance_date = $2`, universeName, period.Rebalance)
+	if err != nil {
+		log.Fatalf("Unable to insert to the '%s' table | %v", universeSettlementsTableName, err)
+	}
+	refreshSettlementStats(ctx, dbpool, period.Rebalance, period.End)
+}
+
+// refreshSettlementStats refreshes the continuous aggregate over [start, end).
+// Zero times leave the window open on that side
+func refreshSettlementStats(ctx context.Context, dbpool *pgxpool.Pool, start time.Time, end time.Time) {
+	startArg, endArg := "NULL", "NULL"
+	if !start.IsZero() {
+		startArg = "'" + start.UTC().Format(time.RFC3339) + "'"
+	}
+	if !end.IsZero() {
+		endArg = "'" + end.UTC().Format(time.RFC3339) + "'"
+	}
+	// refresh_continuous_aggregate can't run inside a transaction, so the
+	// window is inlined to send it without arguments over the simple protocol
+	_, err := dbpool.Exec(ctx, `CALL refresh_continuous_aggregate('`+settlementStatsViewName+`', `+startArg+`::TIMESTAMPTZ, `+endArg+`::TIMESTAMPTZ)`)
+	if err != nil {
+		log.Fatalf("Unable to refresh the '%s' continuous aggregate | %v", settlementStatsViewName, err)
+	}
+}
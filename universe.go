@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/readysetliqd/binance-funding-rates-go/data"
+)
+
+// UniverseSelector decides which symbols make up a universe. The ingester
+// walks the candidates in the order Order returns them and keeps the first
+// Size symbols with complete funding history. Every table of the universe is
+// prefixed with Name so universes built by different selectors can be compared
+type UniverseSelector interface {
+	Name() string
+	Size() int
+	// Order filters and orders the CMC ranked candidates for the period
+	// starting at rebalance, returning audit records for the candidates it drops
+	Order(ctx context.Context, rebalance time.Time, candidates []data.Symbol) ([]data.Symbol, []data.AuditRecord)
+}
+
+// Audit reasons for candidates dropped by a UniverseSelector
+const (
+	reasonOutsideBand    = "outside rank band"
+	reasonNotInList      = "not in fixed symbol list"
+	reasonNoVolume       = "no quote volume data"
+	reasonNoOpenInterest = "no open interest data"
+)
+
+// rankSelector selects the top size symbols by CoinMarketCap rank
+type rankSelector struct {
+	size int
+}
+
+func (s rankSelector) Name() string { return "top" + strconv.Itoa(s.size) }
+func (s rankSelector) Size() int    { return s.size }
+
+func (s rankSelector) Order(ctx context.Context, rebalance time.Time, candidates []data.Symbol) ([]data.Symbol, []data.AuditRecord) {
+	return candidates, nil
+}
+
+// rankBandSelector selects every symbol ranked from..to (inclusive) by
+// CoinMarketCap, eg. ranks 11-50
+type rankBandSelector struct {
+	from int64
+	to   int64
+}
+
+func (s rankBandSelector) Name() string {
+	return "rank" + strconv.FormatInt(s.from, 10) + "to" + strconv.FormatInt(s.to, 10)
+}
+func (s rankBandSelector) Size() int { return int(s.to - s.from + 1) }
+
+func (s rankBandSelector) Order(ctx context.Context, rebalance time.Time, candidates []data.Symbol) ([]data.Symbol, []data.AuditRecord) {
+	var ordered []data.Symbol
+	var audit []data.AuditRecord
+	for _, candidate := range candidates {
+		if candidate.Rank < s.from || candidate.Rank > s.to {
+			audit = append(audit, newAuditRecord(candidate, reasonOutsideBand, fmt.Sprintf("ranks %d-%d", s.from, s.to)))
+			continue
+		}
+		ordered = append(ordered, candidate)
+	}
+	return ordered, audit
+}
+
+// fixedSelector selects a hand picked list of symbols, as stored in the
+// database (eg. "PEPE" rather than "1000PEPE"), in the order listed
+type fixedSelector struct {
+	name    string
+	symbols []string
+}
+
+func (s fixedSelector) Name() string { return s.name }
+func (s fixedSelector) Size() int    { return len(s.symbols) }
+
+func (s fixedSelector) Order(ctx context.Context, rebalance time.Time, candidates []data.Symbol) ([]data.Symbol, []data.AuditRecord) {
+	var ordered []data.Symbol
+	var audit []data.AuditRecord
+	for _, symbol := range s.symbols {
+		for _, candidate := range candidates {
+			if candidate.Symbol == symbol {
+				ordered = append(ordered, candidate)
+			}
+		}
+	}
+	for _, candidate := range candidates {
+		found := false
+		for _, symbol := range s.symbols {
+			if candidate.Symbol == symbol {
+				found = true
+				break
+			}
+		}
+		if !found {
+			audit = append(audit, newAuditRecord(candidate, reasonNotInList, ""))
+		}
+	}
+	return ordered, audit
+}
+
+// volumeSelector selects the top size symbols by Binance perp quote volume
+// over the 7 days before the rebalance, among the first candidatePool CMC
+// ranked candidates
+type volumeSelector struct {
+	size          int
+	candidatePool int
+}
+
+func (s volumeSelector) Name() string { return "volume" + strconv.Itoa(s.size) }
+func (s volumeSelector) Size() int    { return s.size }
+
+func (s volumeSelector) Order(ctx context.Context, rebalance time.Time, candidates []data.Symbol) ([]data.Symbol, []data.AuditRecord) {
+	return orderByMetric(candidates, s.candidatePool, reasonNoVolume, func(contract string) (float64, bool) {
+		return quoteVolume(contract, rebalance)
+	})
+}
+
+// quoteVolume returns the quote volume of a Binance perp contract over the 7
+// days before t, or false if binance has no klines for it
+func quoteVolume(contract string, t time.Time) (float64, bool) {
+	url := fmt.Sprintf("https://fapi.binance.com/fapi/v1/klines?symbol=%s&interval=1d&limit=7&endTime=%v", contract, t.UnixMilli()-1)
+	var respInfc [][]interface{}
+	if !getJson(url, &respInfc) || len(respInfc) == 0 {
+		return 0, false
+	}
+	var volume float64
+	for _, kline := range respInfc {
+		quoteVolume, err := strconv.ParseFloat(kline[7].(string), 64)
+		if err != nil {
+			log.Fatal("error parsing float | ", err)
+		}
+		volume += quoteVolume
+	}
+	// from binance api: weight = 1 for limit [1,100). 2400 weight/min = 40 queries/sec
+	time.Sleep(time.Millisecond * 25)
+	return volume, true
+}
+
+// openInterestSelector selects the top size symbols by Binance open interest
+// value at the rebalance, among the first candidatePool CMC ranked candidates.
+// Binance only serves the latest month of open interest history, so older
+// snapshots have no candidates
+type openInterestSelector struct {
+	size          int
+	candidatePool int
+}
+
+func (s openInterestSelector) Name() string { return "oi" + strconv.Itoa(s.size) }
+func (s openInterestSelector) Size() int    { return s.size }
+
+func (s openInterestSelector) Order(ctx context.Context, rebalance time.Time, candidates []data.Symbol) ([]data.Symbol, []data.AuditRecord) {
+	// binance has no open interest to select by, so candidates aren't polled
+	if rebalance.Before(time.Now().Add(-futuresDataLookback)) {
+		log.Printf("Rebalance %s is outside the openInterestHist lookback, no open interest to select by", rebalance.Format("2006-01-02"))
+		var audit []data.AuditRecord
+		for _, candidate := range candidates {
+			audit = append(audit, newAuditRecord(candidate, reasonNoOpenInterest, "rebalance before the openInterestHist lookback"))
+		}
+		return nil, audit
+	}
+	return orderByMetric(candidates, s.candidatePool, reasonNoOpenInterest, func(contract string) (float64, bool) {
+		return openInterestValue(contract, rebalance)
+	})
+}
+
+// openInterestValue returns the open interest value of a Binance perp contract
+// at t, or false if binance has no open interest for it, eg. t is before the
+// lookback
+func openInterestValue(contract string, t time.Time) (float64, bool) {
+	url := fmt.Sprintf("https://fapi.binance.com/futures/data/openInterestHist?symbol=%s&period=5m&limit=1&endTime=%v", contract, t.UnixMilli())
+	var openInterests []map[string]interface{}
+	if !getJson(url, &openInterests) || len(openInterests) == 0 {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(openInterests[0]["sumOpenInterestValue"].(string), 64)
+	if err != nil {
+		log.Fatal("error parsing float | ", err)
+	}
+	// binance /futures/data rate limit: 1000/5min/IP
+	time.Sleep(300 * time.Millisecond)
+	return value, true
+}
+
+// orderByMetric sorts the first pool candidates by metric, highest first.
+// Candidates without the metric are dropped with reason
+func orderByMetric(candidates []data.Symbol, pool int, reason string, metric func(contract string) (float64, bool)) ([]data.Symbol, []data.AuditRecord) {
+	if len(candidates) > pool {
+		candidates = candidates[:pool]
+	}
+	var ordered []data.Symbol
+	var audit []data.AuditRecord
+	values := make(map[string]float64)
+	for _, candidate := range candidates {
+		value, ok := metric(candidate.Contract)
+		if !ok {
+			audit = append(audit, newAuditRecord(candidate, reason, ""))
+			continue
+		}
+		values[candidate.Symbol] = value
+		ordered = append(ordered, candidate)
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return values[ordered[i].Symbol] > values[ordered[j].Symbol]
+	})
+	return ordered, audit
+}
+
+// getJson polls url and unmarshals the response into v, returning false if
+// the response doesn't match v, eg. an error message for an unknown symbol
+func getJson(url string, v any) bool {
+	res, err := http.Get(url)
+	if err != nil {
+		log.Fatal("http.Get error | ", err)
+	}
+	defer res.Body.Close()
+	msg, err := io.ReadAll(res.Body)
+	if err != nil {
+		log.Fatal("io.ReadAll error | ", err)
+	}
+	return json.Unmarshal(msg, v) == nil
+}
+
+// rankedCandidates builds the slice of symbols to check for funding rate
+// history on Binance at snapshot, with their CoinMarketCap ranks, sorted by
+// rank. CMC assets are matched to Binance contracts by their stable asset id,
+// see assets.go, and known stablecoins are dropped whichever branch builds the
+// list. Returns audit records for the candidates dropped along the way
+func rankedCandidates(ctx context.Context, dbpool *pgxpool.Pool, snapshot time.Time, stablecoins stablecoinClassifier) ([]data.Symbol, []data.AuditRecord) {
+	var queuedAudit []data.AuditRecord
+	// #region Map the ranked CMC assets at snapshot to Binance contracts
+	contracts, ambiguous := snapshotContracts(ctx, dbpool, snapshot)
+	recordAmbiguousTickers(ctx, dbpool, snapshot, ambiguous)
+	for _, ticker := range ambiguous {
+		if !ticker.Chosen {
+			candidate := data.Symbol{Symbol: ticker.Symbol, Rank: ticker.Rank, AssetId: ticker.AssetId, Contract: ticker.BinanceSymbol}
+			queuedAudit = append(queuedAudit, newAuditRecord(candidate, reasonDuplicate, "another CMC asset maps to the contract"))
+		}
+	} // #endregion
+
+	// #region Set slice of contracts to check for funding rate history on Binance
+	var symbols []string
+	// HARDCODED WORKAROUND
+	// Binance futures only had 3 markets in 2019, 80 markets in 2020.
+	// Hardcoding the symbols list speeds up the data collection by avoiding
+	// unneccessary API calls especially with higher values for topN const (20+)
+	// Symbols lists made by hand reading through Binance announcements
+	switch {
+	case snapshot.Before(time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)):
+		symbols = data.SymbolsBefore2020
+	case snapshot.Before(time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)):
+		symbols = data.SymbolsBefore2021
+	case snapshot.Before(time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)):
+		symbols = data.SymbolsBefore2022
+	case snapshot.Before(time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)):
+		symbols = data.SymbolsBefore2023
+	case snapshot.Before(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)):
+		symbols = data.SymbolsBefore2024
+	default:
+		// every ranked CMC asset
+		for contract := range contracts {
+			symbols = append(symbols, strings.TrimSuffix(contract, "USDT"))
+		}
+	}
+	// #endregion
+
+	// #region Build slice of symbols with their ranks from the matched assets
+	var symbolStructs []data.Symbol
+	for _, symbol := range symbols {
+		// symbols lists hold Binance base assets, eg. "1000SHIB" or "LUNA2"
+		contract := symbol + "USDT"
+		asset, ok := contracts[contract]
+		if !ok {
+			queuedAudit = append(queuedAudit, newAuditRecord(data.Symbol{Symbol: dbSymbol(contract), Contract: contract}, reasonNoRank, ""))
+			continue
+		}
+		var newSymbol = data.Symbol{
+			Symbol:   asset.Symbol,
+			Rank:     asset.Rank,
+			AssetId:  asset.Id,
+			Contract: contract,
+		}
+		if stablecoins.isListed(newSymbol.Symbol) {
+			queuedAudit = append(queuedAudit, newAuditRecord(newSymbol, reasonStablecoin, "known stablecoin"))
+			continue
+		}
+		symbolStructs = append(symbolStructs, newSymbol)
+	}
+	sort.Slice(symbolStructs[:], func(i, j int) bool {
+		return symbolStructs[i].Rank < symbolStructs[j].Rank
+	}) // #endregion
+	return symbolStructs, queuedAudit
+}